@@ -0,0 +1,198 @@
+package mailx
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// @author valor.
+
+// The connection of a worker is closed
+// if no email was sent in the last 30 seconds.
+const asyncIdleTimeout = 30 * time.Second
+
+// ErrSenderClosed is returned by AsyncSender after it is shut down.
+var ErrSenderClosed = errors.New("async sender is shut down")
+
+// Result is the result of sending an email asynchronously.
+type Result struct {
+	// Message is the email sent.
+	Message *Message
+	// Receipt is the receipt of the server, including its queue id,
+	// or nil if the email was not sent.
+	Receipt *Receipt
+	// Err is the error of sending, or nil if the email was sent.
+	Err error
+}
+
+type asyncJob struct {
+	ctx    context.Context
+	m      *Message
+	result chan Result
+}
+
+// AsyncSender sends emails in the background via a bounded pool of workers.
+// Each worker keeps its own connection to the server, which is reused
+// for the following emails.
+type AsyncSender struct {
+	d    *Dialer
+	jobs chan *asyncJob
+
+	// ctx is canceled if the shutdown times out.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+	quit    chan struct{}
+}
+
+// NewAsyncSender starts the workers sending emails via the Dialer.
+// At most queueSize emails wait for the workers, SendAsync blocks
+// when the queue is full.
+func NewAsyncSender(d *Dialer, workers, queueSize int) *AsyncSender {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &AsyncSender{
+		d:      d,
+		jobs:   make(chan *asyncJob, queueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		quit:   make(chan struct{}),
+	}
+	a.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go a.work()
+	}
+	return a
+}
+
+// SendAsync queues the email, and returns the channel
+// which receives the result once the email is sent.
+//
+// It blocks while the queue is full, until the context is done.
+// The email is not sent if the context is done before sending.
+func (a *AsyncSender) SendAsync(ctx context.Context, m *Message) <-chan Result {
+	result := make(chan Result, 1)
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		result <- Result{Message: m, Err: ErrSenderClosed}
+		return result
+	}
+	a.pending.Add(1)
+	a.mu.Unlock()
+
+	select {
+	case a.jobs <- &asyncJob{ctx: ctx, m: m, result: result}:
+	case <-ctx.Done():
+		a.pending.Done()
+		result <- Result{Message: m, Err: ctx.Err()}
+	}
+	return result
+}
+
+// work sends the queued emails until the sender is shut down.
+func (a *AsyncSender) work() {
+	defer a.workers.Done()
+
+	var s *Sender
+	defer func() {
+		if s != nil {
+			s.Close()
+		}
+	}()
+
+	idle := time.NewTimer(asyncIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case job := <-a.jobs:
+			var r Result
+			s, r = a.send(s, job)
+			job.result <- r
+			a.pending.Done()
+		case <-idle.C:
+			if s != nil {
+				s.Close()
+				s = nil
+			}
+		case <-a.quit:
+			return
+		}
+
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(asyncIdleTimeout)
+	}
+}
+
+// send sends the email of the job, reusing the connection if any.
+// It returns the connection for the next email, or nil if it is broken.
+func (a *AsyncSender) send(s *Sender, job *asyncJob) (*Sender, Result) {
+	r := Result{Message: job.m}
+	if r.Err = job.ctx.Err(); r.Err != nil {
+		return s, r
+	}
+	if r.Err = a.ctx.Err(); r.Err != nil {
+		return s, r
+	}
+
+	if s == nil {
+		if s, r.Err = a.d.DialContext(a.ctx); r.Err != nil {
+			return nil, r
+		}
+	}
+	r.Receipt, r.Err = s.SendContext(job.ctx, job.m)
+	if r.Err != nil {
+		// The state of the connection is unknown.
+		s.Close()
+		return nil, r
+	}
+	return s, r
+}
+
+// Shutdown stops accepting emails, and waits for the queued ones to be sent.
+// If the context is done first, the error of the context is returned,
+// and the emails not yet sent fail with context.Canceled.
+func (a *AsyncSender) Shutdown(ctx context.Context) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ErrSenderClosed
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		a.pending.Wait()
+		close(a.quit)
+		a.workers.Wait()
+		a.cancel()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		a.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,130 @@
+package mailx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsyncSender(t *testing.T) {
+	var done <-chan error
+	d := &Dialer{
+		Host: "smtp.example.com",
+		Port: 25,
+
+		StartTLSPolicy: NoStartTLS,
+	}
+	d.NetDialer = scriptDialer([]string{
+		"S: 220 smtp.example.com ESMTP",
+		"C: EHLO localhost",
+		"S: 250 smtp.example.com",
+		"C: MAIL FROM:<alex@example.com>",
+		"S: 250 2.1.0 Ok",
+		"C: RCPT TO:<aaa@example.com>",
+		"S: 250 2.1.5 Ok",
+		"C: DATA",
+		"S: 354 End data with <CR><LF>.<CR><LF>",
+		"C: <DATA>",
+		"S: 250 2.0.0 Ok: queued as 4F2A1",
+		"C: MAIL FROM:<alex@example.com>",
+		"S: 250 2.1.0 Ok",
+		"C: RCPT TO:<bbb@example.com>",
+		"S: 250 2.1.5 Ok",
+		"C: DATA",
+		"S: 354 End data with <CR><LF>.<CR><LF>",
+		"C: <DATA>",
+		"S: 250 2.0.0 Ok: queued as 4F2A2",
+		"C: QUIT",
+		"S: 221 2.0.0 Bye",
+	}, &done)
+
+	a := NewAsyncSender(d, 1, 2)
+	results := make([]<-chan Result, 0, 2)
+	for _, to := range []string{"aaa@example.com", "bbb@example.com"} {
+		m := NewMessage()
+		m.SetSender("alex@example.com")
+		m.SetTo(to)
+		m.SetSubject("This is a subject of email.")
+		results = append(results, a.SendAsync(context.Background(), m))
+	}
+
+	for i, want := range []string{"4F2A1", "4F2A2"} {
+		r := <-results[i]
+		if r.Err != nil {
+			t.Fatalf("#%d: send: %s", i, r.Err.Error())
+		}
+		if r.Receipt.QueueID != want || r.Receipt.Reply != "2.0.0 Ok: queued as "+want {
+			t.Fatalf("#%d: invalid receipt: %+v", i, r.Receipt)
+		}
+		if !strings.HasSuffix(r.Receipt.MessageID, "@GolangMailxMessageID>") || len(r.Receipt.Accepted) != 1 || r.Receipt.Size == 0 || r.Receipt.Start.IsZero() {
+			t.Fatalf("#%d: invalid receipt: %+v", i, r.Receipt)
+		}
+	}
+
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %s", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server: %s", err.Error())
+	}
+	if r := <-a.SendAsync(context.Background(), NewMessage()); !errors.Is(r.Err, ErrSenderClosed) {
+		t.Fatalf("expected ErrSenderClosed, got %v", r.Err)
+	}
+}
+
+func TestAsyncSenderShutdown(t *testing.T) {
+	d := &Dialer{
+		Host: "smtp.example.com",
+		Port: 25,
+		NetDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com")
+
+	a := NewAsyncSender(d, 1, 0)
+	r1 := a.SendAsync(context.Background(), m)
+
+	// the queue is full while the worker is dialing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if r := <-a.SendAsync(ctx, m); !errors.Is(r.Err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", r.Err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := a.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if r := <-r1; r.Err == nil {
+		t.Fatalf("expected error of the canceled sending")
+	}
+	if err := a.Shutdown(context.Background()); !errors.Is(err, ErrSenderClosed) {
+		t.Fatalf("expected ErrSenderClosed, got %v", err)
+	}
+}
+
+func TestParseQueueID(t *testing.T) {
+	tests := map[string]string{
+		"2.0.0 Ok: queued as 4F2A1":                      "4F2A1",
+		"2.0.0 Ok: queued as 4F2A1.":                     "4F2A1",
+		"OK id=1tWvXy-0001aB-Cd":                         "1tWvXy-0001aB-Cd",
+		"2.0.0 4BJ3Kx1234 Message accepted for delivery": "4BJ3Kx1234",
+		"2.0.0 OK  1700000000 a1-20020a17.123 - gsmtp":   "",
+		"Queued mail for delivery":                       "",
+		"":                                               "",
+	}
+	for reply, want := range tests {
+		if got := parseQueueID(reply); got != want {
+			t.Fatalf("parseQueueID(%q): got %q, want %q", reply, got, want)
+		}
+	}
+}
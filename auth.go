@@ -48,3 +48,33 @@ func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 	}
 	return nil, errors.New("unexpected server challenge: " + string(fromServer))
 }
+
+// externalAuth implements the EXTERNAL authentication mechanism of the SMTP.
+// The credentials are the client certificate presented during the TLS handshake.
+type externalAuth struct {
+	// identity is the optional authorization identity.
+	identity string
+}
+
+// Start implements the stmp.Auth's Start.
+func (a *externalAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// The client certificate is only exchanged over TLS.
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	// No initial response, so that an empty authorization identity
+	// can be sent as an empty response to the server's challenge.
+	return "EXTERNAL", nil, nil
+}
+
+// Next implements the stmp.Auth's Next.
+func (a *externalAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	if len(fromServer) != 0 {
+		return nil, errors.New("unexpected server challenge: " + string(fromServer))
+	}
+	return []byte(a.identity), nil
+}
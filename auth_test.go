@@ -113,3 +113,55 @@ func TestLoginAuthNextErr(t *testing.T) {
 		t.Fatalf("invalid response")
 	}
 }
+
+func TestExternalAuth(t *testing.T) {
+	auth := &externalAuth{identity: "user@example.com"}
+	server := &smtp.ServerInfo{
+		Name: "smtp.example.com",
+		TLS:  true,
+		Auth: []string{"EXTERNAL"},
+	}
+
+	proto, toServer, err := auth.Start(server)
+	if err != nil {
+		t.Fatalf("externalAuth Start(): %s", err.Error())
+	}
+	if proto != "EXTERNAL" {
+		t.Fatalf("invalid protocol, got '%s', want 'EXTERNAL'", proto)
+	}
+	if toServer != nil {
+		t.Fatalf("invalid response, got '%s', want 'nil'", toServer)
+	}
+
+	toServer, err = auth.Next([]byte(""), true)
+	if err != nil {
+		t.Fatalf("externalAuth Next(): %s", err.Error())
+	}
+	if string(toServer) != auth.identity {
+		t.Fatalf("invalid identity, got '%s', want '%s'", toServer, auth.identity)
+	}
+
+	toServer, err = auth.Next(nil, false)
+	if err != nil || toServer != nil {
+		t.Fatalf("invalid response")
+	}
+}
+
+func TestExternalAuthErr(t *testing.T) {
+	auth := &externalAuth{}
+	server := &smtp.ServerInfo{
+		Name: "smtp.example.com",
+		TLS:  false,
+		Auth: []string{"EXTERNAL"},
+	}
+
+	proto, toServer, err := auth.Start(server)
+	if err == nil || proto != "" || toServer != nil {
+		t.Fatalf("invalid response")
+	}
+
+	toServer, err = auth.Next([]byte("everything"), true)
+	if err == nil || toServer != nil {
+		t.Fatalf("invalid response")
+	}
+}
@@ -0,0 +1,316 @@
+package mailx
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+)
+
+// @author valor.
+
+// client is a client of the SMTP or LMTP server.
+// It follows net/smtp's Client, and additionally keeps the reply
+// to the final dot of DATA, speaks LHLO and reads one reply
+// per recipient after DATA in LMTP mode.
+type client struct {
+	text *textproto.Conn
+	conn net.Conn
+	tls  bool
+
+	serverName string
+	localName  string
+	lmtp       bool
+
+	ext  map[string]string
+	auth []string
+
+	didHello bool
+	helloErr error
+
+	// rcpts is the accepted recipients of the current mail transaction.
+	rcpts []string
+	// reply is the reply text to the final dot of DATA.
+	reply string
+	// status is the replies to the final dot of DATA, one per recipient in LMTP mode.
+	status []RcptStatus
+}
+
+func newClient(conn net.Conn, host string, lmtp bool) (*client, error) {
+	text := textproto.NewConn(conn)
+	_, _, err := text.ReadResponse(220)
+	if err != nil {
+		text.Close()
+		return nil, err
+	}
+
+	c := &client{
+		text:       text,
+		conn:       conn,
+		tls:        isTLSConn(conn),
+		serverName: host,
+		localName:  "localhost",
+		lmtp:       lmtp,
+	}
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *client) Close() error {
+	return c.text.Close()
+}
+
+func (c *client) hello() error {
+	if !c.didHello {
+		c.didHello = true
+		c.helloErr = c.ehlo()
+		if c.helloErr != nil && !c.lmtp {
+			c.helloErr = c.helo()
+		}
+	}
+	return c.helloErr
+}
+
+// Hello sends a HELO, EHLO or LHLO to the server as the given host name.
+// Calling this method is only necessary if the client needs control
+// over the host name used. If Hello is called, it must be called
+// before any of the other methods.
+func (c *client) Hello(localName string) error {
+	if err := validateLine(localName); err != nil {
+		return err
+	}
+	if c.didHello {
+		return errors.New("smtp: Hello called after other methods")
+	}
+	c.localName = localName
+	return c.hello()
+}
+
+func (c *client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expectCode)
+}
+
+func (c *client) helo() error {
+	c.ext = nil
+	_, _, err := c.cmd(250, "HELO %s", c.localName)
+	return err
+}
+
+func (c *client) ehlo() error {
+	verb := "EHLO"
+	if c.lmtp {
+		verb = "LHLO"
+	}
+	_, msg, err := c.cmd(250, "%s %s", verb, c.localName)
+	if err != nil {
+		return err
+	}
+
+	ext := make(map[string]string)
+	extList := strings.Split(msg, "\n")
+	if len(extList) > 1 {
+		extList = extList[1:]
+		for _, line := range extList {
+			args := strings.SplitN(line, " ", 2)
+			if len(args) > 1 {
+				ext[strings.ToUpper(args[0])] = args[1]
+			} else {
+				ext[strings.ToUpper(args[0])] = ""
+			}
+		}
+	}
+	if mechs, ok := ext["AUTH"]; ok {
+		c.auth = strings.Fields(mechs)
+	}
+	c.ext = ext
+	return nil
+}
+
+// StartTLS sends the STARTTLS command and encrypts all further communication.
+func (c *client) StartTLS(config *tls.Config) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(220, "STARTTLS")
+	if err != nil {
+		return err
+	}
+	if tc, ok := c.conn.(*traceConn); ok {
+		c.conn = tc.startTLS(config)
+	} else {
+		c.conn = tls.Client(c.conn, config)
+	}
+	c.text = textproto.NewConn(c.conn)
+	c.tls = true
+	return c.ehlo()
+}
+
+// Extension reports whether an extension is support by the server.
+func (c *client) Extension(ext string) (bool, string) {
+	if err := c.hello(); err != nil {
+		return false, ""
+	}
+	if c.ext == nil {
+		return false, ""
+	}
+	ext = strings.ToUpper(ext)
+	param, ok := c.ext[ext]
+	return ok, param
+}
+
+// Auth authenticates a client using the provided authentication mechanism.
+func (c *client) Auth(a smtp.Auth) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	encoding := base64.StdEncoding
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: c.serverName, TLS: c.tls, Auth: c.auth})
+	if err != nil {
+		c.Quit()
+		return err
+	}
+	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
+	encoding.Encode(resp64, resp)
+	code, msg64, err := c.cmd(0, "%s", strings.TrimSpace("AUTH "+mech+" "+string(resp64)))
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = encoding.DecodeString(msg64)
+		case 235:
+			// the last message isn't base64 because it isn't a challenge
+			msg = []byte(msg64)
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
+		if err != nil {
+			// abort the AUTH
+			c.cmd(501, "*")
+			c.Quit()
+			break
+		}
+		if resp == nil {
+			break
+		}
+		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
+		encoding.Encode(resp64, resp)
+		code, msg64, err = c.cmd(0, "%s", resp64)
+	}
+	return err
+}
+
+// Mail issues a MAIL command to the server using the provided email address.
+func (c *client) Mail(from string) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	if err := c.hello(); err != nil {
+		return err
+	}
+	c.rcpts = nil
+	c.reply = ""
+	c.status = nil
+
+	cmdStr := "MAIL FROM:<%s>"
+	if _, ok := c.ext["8BITMIME"]; ok {
+		cmdStr += " BODY=8BITMIME"
+	}
+	_, _, err := c.cmd(250, cmdStr, from)
+	return err
+}
+
+// Rcpt issues a RCPT command to the server using the provided email address.
+func (c *client) Rcpt(to string) error {
+	if err := validateLine(to); err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(25, "RCPT TO:<%s>", to); err != nil {
+		return err
+	}
+	c.rcpts = append(c.rcpts, to)
+	return nil
+}
+
+type dataCloser struct {
+	c *client
+	io.WriteCloser
+}
+
+// Close implements io.Closer
+func (d *dataCloser) Close() error {
+	d.WriteCloser.Close()
+	if !d.c.lmtp {
+		_, msg, err := d.c.text.ReadResponse(250)
+		d.c.reply = msg
+		return err
+	}
+
+	// In LMTP mode, the server replies for each accepted recipient.
+	status := make([]RcptStatus, 0, len(d.c.rcpts))
+	for _, rcpt := range d.c.rcpts {
+		code, msg, err := d.c.text.ReadResponse(250)
+		if err != nil {
+			protoErr, ok := err.(*textproto.Error)
+			if !ok {
+				return err
+			}
+			code, msg = protoErr.Code, protoErr.Msg
+		}
+		status = append(status, RcptStatus{Rcpt: rcpt, Code: code, Msg: msg})
+	}
+	d.c.status = status
+	return nil
+}
+
+// Data issues a DATA command to the server and returns a writer that
+// can be used to write the mail headers and body.
+func (c *client) Data() (io.WriteCloser, error) {
+	_, _, err := c.cmd(354, "DATA")
+	if err != nil {
+		return nil, err
+	}
+	return &dataCloser{c, c.text.DotWriter()}, nil
+}
+
+// dataReply returns the reply text of the last DATA.
+func (c *client) dataReply() string {
+	return c.reply
+}
+
+// rcptStatus returns the replies of the last DATA in LMTP mode.
+func (c *client) rcptStatus() []RcptStatus {
+	return c.status
+}
+
+// Quit sends the QUIT command and closes the connection to the server.
+func (c *client) Quit() error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(221, "QUIT")
+	if err != nil {
+		return err
+	}
+	return c.text.Close()
+}
+
+// validateLine checks to see if a line has CR or LF as per RFC 5321
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\n\r") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package mailx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// serveScript plays the server side of an SMTP conversation on conn.
+// The lines prefixed with "S: " are sent to the client, and the lines
+// prefixed with "C: " are expected from the client as prefixes.
+// The line "C: <DATA>" reads the message until the final dot.
+func serveScript(conn net.Conn, script []string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		done <- playScript(textproto.NewConn(conn), script)
+	}()
+	return done
+}
+
+func playScript(text *textproto.Conn, script []string) error {
+	for _, line := range script {
+		switch {
+		case strings.HasPrefix(line, "S: "):
+			if err := text.PrintfLine("%s", line[3:]); err != nil {
+				return err
+			}
+		case line == "C: <DATA>":
+			if _, err := text.ReadDotBytes(); err != nil {
+				return err
+			}
+		default:
+			got, err := text.ReadLine()
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(got, line[3:]) {
+				return errors.New("got '" + got + "', want '" + line[3:] + "'")
+			}
+		}
+	}
+	return nil
+}
+
+func scriptDialer(script []string, done *<-chan error) DialContextFunc {
+	return func(context.Context, string, string) (net.Conn, error) {
+		c, s := net.Pipe()
+		*done = serveScript(s, script)
+		return c, nil
+	}
+}
+
+func TestLMTP(t *testing.T) {
+	var done <-chan error
+	d := &Dialer{
+		Host:      "lmtp.example.com",
+		Port:      24,
+		LocalName: "mx.example.com",
+		LMTP:      true,
+
+		StartTLSPolicy: NoStartTLS,
+	}
+	d.NetDialer = scriptDialer([]string{
+		"S: 220 lmtp.example.com LMTP ready",
+		"C: LHLO mx.example.com",
+		"S: 250-lmtp.example.com",
+		"S: 250-PIPELINING",
+		"S: 250 ENHANCEDSTATUSCODES",
+		"C: MAIL FROM:<alex@example.com>",
+		"S: 250 2.1.0 Ok",
+		"C: RCPT TO:<aaa@example.com>",
+		"S: 250 2.1.5 Ok",
+		"C: RCPT TO:<bbb@example.com>",
+		"S: 250 2.1.5 Ok",
+		"C: DATA",
+		"S: 354 Start mail input",
+		"C: <DATA>",
+		"S: 250 2.0.0 <aaa@example.com> Saved",
+		"S: 452 4.2.2 <bbb@example.com> Mailbox full",
+		"C: QUIT",
+		"S: 221 2.0.0 Bye",
+	}, &done)
+
+	s, err := d.Dial()
+	if err != nil {
+		t.Fatalf("dial: %s", err.Error())
+	}
+
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com", "bbb@example.com")
+	m.SetSubject("This is a subject of email.")
+	m.SetPlainBody("This is a text/plain body.")
+
+	r, err := s.SendWithReceipt(m)
+	var rcptErr *RcptError
+	if !errors.As(err, &rcptErr) {
+		t.Fatalf("expected *RcptError, got %v", err)
+	}
+	if len(rcptErr.Rcpt) != 1 || rcptErr.Rcpt[0].Rcpt != "bbb@example.com" || rcptErr.Rcpt[0].Code != 452 {
+		t.Fatalf("invalid failed recipients: %+v", rcptErr.Rcpt)
+	}
+	if r == nil || len(r.Rcpt) != 2 || !r.Rcpt[0].OK() || r.Rcpt[1].OK() {
+		t.Fatalf("invalid receipt: %+v", r)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("close: %s", err.Error())
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("server: %s", err.Error())
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	c, s := net.Pipe()
+	done := serveScript(s, []string{
+		"S: 220 localhost ESMTP",
+		"C: EHLO localhost",
+		"S: 502 5.5.2 Error: command not recognized",
+		"C: HELO localhost",
+		"S: 250 localhost",
+		"C: QUIT",
+		"S: 221 Bye",
+	})
+	cli, err := newClient(c, "localhost", false)
+	if err != nil {
+		t.Fatalf("newClient: %s", err.Error())
+	}
+	if ok, _ := cli.Extension("AUTH"); ok {
+		t.Fatalf("unexpected extension AUTH after HELO")
+	}
+	if err = cli.Quit(); err != nil {
+		t.Fatalf("quit: %s", err.Error())
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("server: %s", err.Error())
+	}
+
+	c, s = net.Pipe()
+	done = serveScript(s, []string{
+		"S: 220 localhost ESMTP",
+		"C: EHLO localhost",
+		"S: 250-localhost",
+		"S: 250 AUTH LOGIN",
+		"C: AUTH LOGIN",
+		"S: 334 VXNlcm5hbWU6",
+		"C: dXNlcg==",
+		"S: 334 UGFzc3dvcmQ6",
+		"C: cGFzcw==",
+		"S: 235 2.7.0 Authentication successful",
+		"C: QUIT",
+		"S: 221 Bye",
+	})
+	cli, err = newClient(c, "localhost", false)
+	if err != nil {
+		t.Fatalf("newClient: %s", err.Error())
+	}
+	err = cli.Auth(&loginAuth{username: "user", password: "pass", host: "localhost"})
+	if err != nil {
+		t.Fatalf("auth: %s", err.Error())
+	}
+	if err = cli.Quit(); err != nil {
+		t.Fatalf("quit: %s", err.Error())
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("server: %s", err.Error())
+	}
+}
@@ -0,0 +1,188 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// @author valor.
+
+// The fields of a TLSA record usable for SMTP, see RFC 7672 - 3.1.
+const (
+	// TLSAUsageDANETA matches the trust anchor of the server's certificate chain.
+	TLSAUsageDANETA uint8 = 2
+	// TLSAUsageDANEEE matches the server's certificate.
+	TLSAUsageDANEEE uint8 = 3
+
+	// TLSASelectorCert matches the full certificate.
+	TLSASelectorCert uint8 = 0
+	// TLSASelectorSPKI matches the SubjectPublicKeyInfo of the certificate.
+	TLSASelectorSPKI uint8 = 1
+
+	// TLSAMatchingFull matches the exact selected content.
+	TLSAMatchingFull uint8 = 0
+	// TLSAMatchingSHA256 matches the SHA-256 hash of the selected content.
+	TLSAMatchingSHA256 uint8 = 1
+	// TLSAMatchingSHA512 matches the SHA-512 hash of the selected content.
+	TLSAMatchingSHA512 uint8 = 2
+)
+
+// TLSA is a TLSA record, see RFC 6698.
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// usable reports whether the record is usable for SMTP, see RFC 7672 - 3.1.3.
+func (r *TLSA) usable() bool {
+	return (r.Usage == TLSAUsageDANETA || r.Usage == TLSAUsageDANEEE) &&
+		r.Selector <= TLSASelectorSPKI && r.MatchingType <= TLSAMatchingSHA512
+}
+
+// Match reports whether the certificate matches the selector
+// and the matching type of the record.
+func (r *TLSA) Match(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case TLSASelectorCert:
+		data = cert.Raw
+	case TLSASelectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch r.MatchingType {
+	case TLSAMatchingFull:
+		return bytes.Equal(data, r.Data)
+	case TLSAMatchingSHA256:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], r.Data)
+	case TLSAMatchingSHA512:
+		sum := sha512.Sum512(data)
+		return bytes.Equal(sum[:], r.Data)
+	}
+	return false
+}
+
+// TLSAResolver looks up the TLSA records with DNSSEC validation.
+type TLSAResolver interface {
+	// LookupTLSA returns the TLSA records of the name, e.g. "_25._tcp.mail.example.com",
+	// and whether the answer is authenticated by DNSSEC, e.g. the AD bit
+	// from a trusted validating resolver.
+	LookupTLSA(ctx context.Context, name string) (records []TLSA, secure bool, err error)
+}
+
+// VerifyDANE returns a function for tls.Config's VerifyConnection,
+// which verifies the server's certificate chain against the TLSA records,
+// see RFC 7672 - 3.2. The serverNames are the reference identifiers
+// of the DANE-TA(2) records, e.g. the host of the mail exchanger.
+// The certificates are not verified against the system roots,
+// so InsecureSkipVerify should be set.
+func VerifyDANE(records []TLSA, serverNames ...string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("dane: no server certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+
+		usable := false
+		for i := range records {
+			r := &records[i]
+			if !r.usable() {
+				continue
+			}
+			usable = true
+
+			switch r.Usage {
+			case TLSAUsageDANEEE:
+				// The names and the validity period are not checked.
+				if r.Match(leaf) {
+					return nil
+				}
+			case TLSAUsageDANETA:
+				for _, ta := range cs.PeerCertificates {
+					if r.Match(ta) && verifyDANETA(cs.PeerCertificates, ta, serverNames) == nil {
+						return nil
+					}
+				}
+			}
+		}
+
+		if !usable {
+			// An unauthenticated TLS connection is still required,
+			// see RFC 7672 - 2.2.
+			return nil
+		}
+		return errors.New("dane: no TLSA record matches the server certificate")
+	}
+}
+
+// daneDialer applies the TLSA records of the mail exchanger to its Dialer,
+// and reports whether DANE is used, i.e. the records are authenticated by DNSSEC.
+// The existing VerifyConnection of the TLS configuration is called after DANE.
+func daneDialer(ctx context.Context, d *Dialer, resolver TLSAResolver, domain string) (bool, error) {
+	name := "_" + strconv.Itoa(d.Port) + "._tcp." + d.Host
+	records, secure, err := resolver.LookupTLSA(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		// The mail exchanger can't be used if the lookup fails,
+		// otherwise an attacker can downgrade it, see RFC 7672 - 2.2.
+		return false, err
+	}
+	if !secure || len(records) == 0 {
+		return false, nil
+	}
+
+	conf := d.tlsConfig().Clone()
+	verify := conf.VerifyConnection
+	dane := VerifyDANE(records, d.Host, domain)
+	conf.InsecureSkipVerify = true
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := dane(cs); err != nil {
+			return err
+		}
+		if verify != nil {
+			return verify(cs)
+		}
+		return nil
+	}
+
+	d.TLSConfig = conf
+	d.StartTLSPolicy = MandatoryStartTLS
+	return true, nil
+}
+
+// verifyDANETA verifies the chain from the leaf to the trust anchor
+// and the names of the leaf.
+func verifyDANETA(chain []*x509.Certificate, ta *x509.Certificate, serverNames []string) error {
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+	}
+	opts.Roots.AddCert(ta)
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	err := errors.New("dane: empty server name")
+	for _, name := range serverNames {
+		opts.DNSName = name
+		if _, err = chain[0].Verify(opts); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,218 @@
+package mailx
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testChain returns a certificate of the host issued by a test CA.
+func testChain(t *testing.T, host string) (leaf, ca *x509.Certificate) {
+	caCert, _ := testCertificate(t, "ca.example.com")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{host},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert.Leaf, &key.PublicKey, caCert.PrivateKey)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err.Error())
+	}
+	if leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf("parse certificate: %s", err.Error())
+	}
+	return leaf, caCert.Leaf
+}
+
+func TestVerifyDANE(t *testing.T) {
+	leaf, ca := testChain(t, "mail.example.com")
+	other, _ := testChain(t, "mail.example.com")
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}}
+
+	leafSHA256 := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	leafSHA512 := sha512.Sum512(leaf.Raw)
+	caSHA256 := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	otherSHA256 := sha256.Sum256(other.RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		records []TLSA
+		names   []string
+		ok      bool
+	}{
+		{[]TLSA{{3, 1, 1, leafSHA256[:]}}, nil, true},
+		{[]TLSA{{3, 0, 2, leafSHA512[:]}}, nil, true},
+		{[]TLSA{{3, 0, 0, leaf.Raw}}, nil, true},
+		{[]TLSA{{3, 1, 1, otherSHA256[:]}, {3, 1, 1, leafSHA256[:]}}, nil, true},
+		{[]TLSA{{3, 1, 1, otherSHA256[:]}}, nil, false},
+		{[]TLSA{{3, 1, 1, caSHA256[:]}}, nil, false},
+		{[]TLSA{{2, 1, 1, caSHA256[:]}}, []string{"mail.example.com"}, true},
+		{[]TLSA{{2, 1, 1, caSHA256[:]}}, []string{"example.com", "MAIL.example.com"}, true},
+		{[]TLSA{{2, 1, 1, caSHA256[:]}}, []string{"mx.example.com"}, false},
+		{[]TLSA{{2, 1, 1, caSHA256[:]}}, nil, false},
+		// PKIX-TA(0) and PKIX-EE(1) are unusable for SMTP.
+		{[]TLSA{{1, 1, 1, otherSHA256[:]}}, nil, true},
+		{[]TLSA{{1, 1, 1, otherSHA256[:]}, {3, 1, 1, otherSHA256[:]}}, nil, false},
+	}
+	for i, tt := range tests {
+		err := VerifyDANE(tt.records, tt.names...)(cs)
+		if (err == nil) != tt.ok {
+			t.Fatalf("#%d: got %v, want ok %t", i, err, tt.ok)
+		}
+	}
+
+	// the trust anchor must be in the chain of the server
+	cs = tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	if err := VerifyDANE([]TLSA{{2, 1, 1, caSHA256[:]}}, "mail.example.com")(cs); err == nil {
+		t.Fatalf("expected error without trust anchor")
+	}
+	if err := VerifyDANE([]TLSA{{3, 1, 1, leafSHA256[:]}})(tls.ConnectionState{}); err == nil {
+		t.Fatalf("expected error without certificate")
+	}
+}
+
+type mockTLSAResolver struct {
+	records map[string][]TLSA
+	secure  bool
+	err     error
+}
+
+func (r *mockTLSAResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, bool, error) {
+	if r.err != nil {
+		return nil, false, r.err
+	}
+	if records, ok := r.records[name]; ok {
+		return records, r.secure, nil
+	}
+	return nil, r.secure, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestDANEDialer(t *testing.T) {
+	leaf, ca := testChain(t, "mail.example.com")
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}}
+	caSHA256 := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+
+	resolver := &mockTLSAResolver{
+		records: map[string][]TLSA{
+			"_25._tcp.mail.example.com": {{2, 1, 1, caSHA256[:]}},
+		},
+		secure: true,
+	}
+
+	verified := false
+	d := &Dialer{Host: "mail.example.com", Port: 25, TLSConfig: &tls.Config{
+		VerifyConnection: func(tls.ConnectionState) error {
+			verified = true
+			return nil
+		},
+	}}
+	ok, err := daneDialer(context.Background(), d, resolver, "example.com")
+	if err != nil || !ok {
+		t.Fatalf("daneDialer: %t, %v", ok, err)
+	}
+	if d.StartTLSPolicy != MandatoryStartTLS || !d.TLSConfig.InsecureSkipVerify {
+		t.Fatalf("expected mandatory STARTTLS")
+	}
+	if err = d.TLSConfig.VerifyConnection(cs); err != nil || !verified {
+		t.Fatalf("VerifyConnection: %v, verified %t", err, verified)
+	}
+
+	// no records
+	d = &Dialer{Host: "mx.example.com", Port: 25}
+	if ok, err = daneDialer(context.Background(), d, resolver, "example.com"); err != nil || ok {
+		t.Fatalf("expected no DANE, got %t, %v", ok, err)
+	}
+
+	// insecure records
+	resolver.secure = false
+	d = &Dialer{Host: "mail.example.com", Port: 25}
+	if ok, err = daneDialer(context.Background(), d, resolver, "example.com"); err != nil || ok {
+		t.Fatalf("expected no DANE, got %t, %v", ok, err)
+	}
+	if d.StartTLSPolicy != OpportunisticStartTLS {
+		t.Fatalf("expected opportunistic STARTTLS")
+	}
+
+	// lookup failure
+	resolver.err = errors.New("server misbehaving")
+	if _, err = daneDialer(context.Background(), d, resolver, "example.com"); err == nil {
+		t.Fatalf("expected lookup error")
+	}
+}
+
+func TestMXTransportDANE(t *testing.T) {
+	resolver := &mockResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 20},
+				{Host: "mx3.example.com.", Pref: 30},
+			},
+		},
+	}
+	tlsa := &mockTLSAResolver{
+		records: map[string][]TLSA{
+			"_25._tcp.mx2.example.com": {{3, 1, 1, make([]byte, 32)}},
+			"_25._tcp.mx3.example.com": {{3, 1, 1, make([]byte, 32)}},
+		},
+		secure: true,
+	}
+
+	dialed := []string{}
+	stubNewSmtpClient := newSmtpClient
+	defer func() { newSmtpClient = stubNewSmtpClient }()
+	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		dialed = append(dialed, host)
+		if host == "mx3.example.com" {
+			return &mockSmtpClient{map[string]string{"STARTTLS": ""}}, nil
+		}
+		return &mockSmtpClient{map[string]string{}}, nil
+	}
+
+	tr := &MXTransport{
+		Resolver: resolver,
+		DANE:     tlsa,
+		NetDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "mx1.example.com:25" {
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		},
+	}
+
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com")
+	m.SetSubject("This is a subject of email.")
+
+	// mx2.example.com doesn't support STARTTLS.
+	results, err := tr.Deliver(context.Background(), m)
+	if err != nil {
+		t.Fatalf("deliver: %s", err.Error())
+	}
+	if results[0].Host != "mx3.example.com" || !results[0].DANE {
+		t.Fatalf("invalid result: %+v", results[0])
+	}
+	if len(dialed) != 2 || dialed[0] != "mx2.example.com" {
+		t.Fatalf("invalid dialed hosts: %v", dialed)
+	}
+}
@@ -1,6 +1,7 @@
 package mailx
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
@@ -13,9 +14,29 @@ import (
 
 // @author valor.
 
+// StartTLSPolicy defines how the STARTTLS extension is used.
+type StartTLSPolicy int
+
+const (
+	// OpportunisticStartTLS upgrades the connection
+	// if the SMTP server supports the STARTTLS extension.
+	OpportunisticStartTLS StartTLSPolicy = iota
+	// MandatoryStartTLS fails if the SMTP server
+	// doesn't support the STARTTLS extension.
+	MandatoryStartTLS
+	// NoStartTLS never upgrades the connection.
+	NoStartTLS
+)
+
+// DialContextFunc dials a connection to the address on the named network,
+// e.g. net.Dialer's DialContext.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 // Dialer is a dialer to an SMTP server.
 type Dialer struct {
 	// Host represents the host of the SMTP server.
+	// It can also be the path of a Unix domain socket,
+	// e.g. "unix:///var/run/smtpd.sock".
 	Host string
 	// Port represents the port of the SMTP server.
 	Port int
@@ -23,91 +44,254 @@ type Dialer struct {
 	Username string
 	// Password is the password to use to authenticate to the SMTP server.
 	Password string
+	// AuthMechanism forces the SASL mechanism used to authenticate
+	// to the SMTP server: "CRAM-MD5", "PLAIN", "LOGIN" or "EXTERNAL".
+	// If empty, it is chosen from the mechanisms advertised by the server.
+	AuthMechanism string
+	// AuthzID is the optional authorization identity.
+	// It is used by the PLAIN and EXTERNAL mechanisms.
+	AuthzID string
 	// SSLOnConnect defines whether an SSL connection is used.
 	// It should be false while SMTP server use the STARTTLS extension.
 	SSLOnConnect bool
+	// StartTLSPolicy defines how the STARTTLS extension is used.
+	// It is ignored while SSLOnConnect is true.
+	StartTLSPolicy StartTLSPolicy
 	// TSLConfig represents the TLS configuration.
 	// It is used for the TLS (when the
 	// STARTTLS extension is used) or SSL connection.
 	TLSConfig *tls.Config
 	// Timeout is passed to net.Dialer's Timeout.
+	// It also limits NetDialer and the SSL handshake, if NetDialer is set.
 	Timeout time.Duration
+	// NetDialer dials the connection to the SMTP server, e.g. through a proxy.
+	// If nil, a net.Dialer is used.
+	NetDialer DialContextFunc
+	// LocalName is the host name sent by EHLO or LHLO.
+	// If empty, "localhost" is used.
+	LocalName string
+	// LMTP defines whether the LMTP is spoken instead of the SMTP,
+	// e.g. to a local delivery agent. The server replies for each
+	// recipient after DATA, see Sender.SendWithReceipt.
+	LMTP bool
+	// RateLimiter limits the rate of the emails sent via the Dialer.
+	// It can be shared by several Dialers, e.g. of the same account.
+	// Send waits for it before dialing, so that no connection is held
+	// open while waiting, and a Sender waits for it before each email.
+	// If nil, the rate is unlimited.
+	RateLimiter *RateLimiter
+	// Trace receives the transcript of each session with timestamps,
+	// in plaintext for both SSL and STARTTLS. The payloads of AUTH
+	// are always redacted. If nil, no transcript is written.
+	Trace io.Writer
+	// TraceBody defines whether the message after DATA is written
+	// to Trace. If false, only its size is written.
+	TraceBody bool
+	// Observer observes the stages of dialing and sending,
+	// e.g. to export metrics or spans. If nil, nothing is observed.
+	Observer Observer
 }
 
+const unixPrefix = "unix://"
+
 func (d *Dialer) addr() string {
-	return d.Host + ":" + strconv.FormatInt(int64(d.Port), 10)
+	return net.JoinHostPort(d.Host, strconv.FormatInt(int64(d.Port), 10))
+}
+
+// network returns the network and the address of the SMTP server.
+func (d *Dialer) network() (string, string) {
+	if strings.HasPrefix(d.Host, unixPrefix) {
+		return "unix", strings.TrimPrefix(d.Host, unixPrefix)
+	}
+	return "tcp", d.addr()
+}
+
+// serverName returns the name of the SMTP server.
+// It is "localhost" for a Unix domain socket.
+func (d *Dialer) serverName() string {
+	if strings.HasPrefix(d.Host, unixPrefix) {
+		return "localhost"
+	}
+	return d.Host
 }
 
 func (d *Dialer) tlsConfig() *tls.Config {
 	if d.TLSConfig == nil {
-		return &tls.Config{ServerName: d.Host}
+		return &tls.Config{ServerName: d.serverName()}
 	}
 	return d.TLSConfig
 }
 
+func (d *Dialer) hasClientCert() bool {
+	conf := d.tlsConfig()
+	return len(conf.Certificates) > 0 || conf.GetClientCertificate != nil
+}
+
+func hasAuthMechanism(auths, mech string) bool {
+	for _, s := range strings.Fields(auths) {
+		if strings.EqualFold(s, mech) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Dialer) smtpAuth(c smtpClient) (smtp.Auth, error) {
-	if d.Username == "" {
+	mech := strings.ToUpper(d.AuthMechanism)
+	if mech == "" && d.Username == "" && !d.hasClientCert() {
 		return nil, nil
 	}
 
 	ok, auths := c.Extension("AUTH")
 	if !ok {
+		if mech == "" && d.Username == "" {
+			// A client certificate alone does not require authentication.
+			return nil, nil
+		}
 		return nil, errors.New("smtp server doesn't support AUTH")
 	}
 
-	if strings.Contains(auths, "CRAM-MD5") {
-		return smtp.CRAMMD5Auth(d.Username, d.Password), nil
-	}
-	if strings.Contains(auths, "PLAIN") {
-		return smtp.PlainAuth("", d.Username, d.Password, d.Host), nil
+	if mech == "" {
+		switch {
+		case d.Username == "":
+			if !hasAuthMechanism(auths, "EXTERNAL") {
+				return nil, nil
+			}
+			mech = "EXTERNAL"
+		case hasAuthMechanism(auths, "CRAM-MD5"):
+			mech = "CRAM-MD5"
+		case hasAuthMechanism(auths, "PLAIN"):
+			mech = "PLAIN"
+		case hasAuthMechanism(auths, "LOGIN"):
+			mech = "LOGIN"
+		default:
+			return nil, errors.New("no authentication mechanism is implemented: " + auths)
+		}
+	} else if !hasAuthMechanism(auths, mech) {
+		return nil, errors.New("smtp server doesn't support AUTH " + mech + ": " + auths)
 	}
-	if strings.Contains(auths, "LOGIN") {
+
+	switch mech {
+	case "CRAM-MD5":
+		return smtp.CRAMMD5Auth(d.Username, d.Password), nil
+	case "PLAIN":
+		return smtp.PlainAuth(d.AuthzID, d.Username, d.Password, d.serverName()), nil
+	case "LOGIN":
 		return &loginAuth{
 			username: d.Username,
 			password: d.Password,
-			host:     d.Host,
+			host:     d.serverName(),
 		}, nil
+	case "EXTERNAL":
+		return &externalAuth{identity: d.AuthzID}, nil
 	}
-	return nil, errors.New("no authentication mechanism is implemented: " + auths)
+	return nil, errors.New("no authentication mechanism is implemented: " + mech)
 }
 
 // Dial dials and authenticates to an SMTP server.
 // The returned *Sender should be closed when done using it.
 func (d *Dialer) Dial() (*Sender, error) {
+	return d.DialContext(context.Background())
+}
+
+// DialContext is like Dial but takes a context.
+// The context only covers dialing, not the SMTP session.
+func (d *Dialer) DialContext(ctx context.Context) (*Sender, error) {
 	var (
 		conn net.Conn
 		err  error
 	)
-	netDialer := &net.Dialer{Timeout: d.Timeout}
+	network, addr := d.network()
+	start := time.Now()
 
-	if d.SSLOnConnect {
-		tlsDialer := &tls.Dialer{
-			NetDialer: netDialer,
-			Config:    d.tlsConfig(),
-		}
-		conn, err = tlsDial(tlsDialer, "tcp", d.addr())
+	if d.NetDialer != nil {
+		conn, err = d.dialContext(ctx)
 	} else {
-		// debug: openssl s_client -starttls smtp -ign_eof -crlf -connect <host>:<port>
-		conn, err = netDial(netDialer, "tcp", d.addr())
+		netDialer := &net.Dialer{Timeout: d.Timeout}
+
+		if d.SSLOnConnect {
+			tlsDialer := &tls.Dialer{
+				NetDialer: netDialer,
+				Config:    d.tlsConfig(),
+			}
+			conn, err = tlsDial(ctx, tlsDialer, network, addr)
+		} else {
+			// debug: openssl s_client -starttls smtp -ign_eof -crlf -connect <host>:<port>
+			conn, err = netDial(ctx, netDialer, network, addr)
+		}
 	}
+	d.observer().OnDial(network, addr, time.Since(start), err)
 	if err != nil {
 		return nil, err
 	}
-	return d.dial(conn)
+	return d.DialConn(conn)
 }
 
-func (d *Dialer) dial(conn net.Conn) (*Sender, error) {
-	c, err := newSmtpClient(conn, d.Host)
+// dialContext dials the connection with NetDialer.
+func (d *Dialer) dialContext(ctx context.Context) (net.Conn, error) {
+	network, addr := d.network()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	conn, err := d.NetDialer(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
-
 	if !d.SSLOnConnect {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, d.tlsConfig())
+	if err = handshake(ctx, conn, tlsConn.Handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// DialConn starts the SMTP session on an established connection,
+// e.g. to a Unix domain socket, then upgrades and authenticates it
+// like Dial does. If SSLOnConnect is true, conn should be a TLS connection.
+// The returned *Sender should be closed when done using it.
+func (d *Dialer) DialConn(conn net.Conn) (*Sender, error) {
+	var (
+		c   smtpClient
+		err error
+	)
+	if d.Trace != nil {
+		conn = d.traceConn(conn)
+	}
+	if d.LMTP {
+		c, err = newLmtpClient(conn, d.serverName())
+	} else {
+		c, err = newSmtpClient(conn, d.serverName())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d.LocalName != "" {
+		if err = c.Hello(d.LocalName); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if !d.SSLOnConnect && d.StartTLSPolicy != NoStartTLS {
 		if ok, _ := c.Extension("STARTTLS"); ok {
-			if err = c.StartTLS(d.tlsConfig()); err != nil {
+			start := time.Now()
+			err = c.StartTLS(d.tlsConfig())
+			d.observer().OnTLS(time.Since(start), err)
+			if err != nil {
 				c.Close()
 				return nil, err
 			}
+		} else if d.StartTLSPolicy == MandatoryStartTLS {
+			c.Close()
+			return nil, errors.New("smtp server doesn't support STARTTLS")
 		}
 	}
 
@@ -118,37 +302,95 @@ func (d *Dialer) dial(conn net.Conn) (*Sender, error) {
 	}
 
 	if auth != nil {
-		if err = c.Auth(auth); err != nil {
+		start, a := time.Now(), &mechAuth{Auth: auth}
+		err = c.Auth(a)
+		d.observer().OnAuth(a.mech, time.Since(start), err)
+		if err != nil {
 			c.Close()
 			return nil, err
 		}
 	}
-	return &Sender{smtpClient: c, from: d.Username}, nil
+	return &Sender{
+		smtpClient: c,
+		from:       d.Username,
+		limiter:    d.RateLimiter,
+		observer:   d.observer(),
+	}, nil
 }
 
 // DialAndSend opens a connection to the SMTP server,
 // sends the given emails and closes the connection.
 func (d *Dialer) DialAndSend(m *Message) error {
-	s, err := d.Dial()
+	return d.Send(context.Background(), m)
+}
+
+// Send implements Transport.
+// It is like DialAndSend but takes a context for dialing.
+func (d *Dialer) Send(ctx context.Context, m *Message) error {
+	rcpt, err := m.rcpt()
+	if err != nil {
+		return &messageError{err: err}
+	}
+	s, err := d.dialReserved(ctx, rcpt)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	return s.Send(m)
+	_, err = s.SendContext(ctx, m)
+	return err
+}
+
+// dialReserved waits for the rate limiter, if any, before dialing,
+// and the first email sent by the Sender doesn't wait again.
+// The tokens are taken even if dialing fails.
+func (d *Dialer) dialReserved(ctx context.Context, rcpt []string) (*Sender, error) {
+	if d.RateLimiter != nil {
+		if err := d.RateLimiter.Wait(ctx, rcpt); err != nil {
+			return nil, err
+		}
+	}
+	s, err := d.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.reserved = d.RateLimiter != nil
+	return s, nil
+}
+
+func (d *Dialer) observer() Observer {
+	if d.Observer == nil {
+		return NopObserver{}
+	}
+	return d.Observer
+}
+
+// traceConn wraps the connection to write its transcript to Trace.
+func (d *Dialer) traceConn(conn net.Conn) net.Conn {
+	t := &tracer{w: d.Trace, body: d.TraceBody}
+	network, addr := d.network()
+	event := "connected to " + addr + " (" + network + ")"
+	if isTLSConn(conn) {
+		event += " over TLS"
+	}
+	t.event(event)
+	return &traceConn{Conn: conn, t: t}
 }
 
 // Stubbed out for tests.
 var (
-	netDial = func(dialer *net.Dialer, network, addr string) (net.Conn, error) {
-		return dialer.Dial(network, addr)
+	netDial = func(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
 	}
-	tlsDial = func(dialer *tls.Dialer, network, addr string) (net.Conn, error) {
-		return dialer.Dial(network, addr)
+	tlsDial = func(ctx context.Context, dialer *tls.Dialer, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
 	}
 
 	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
-		return smtp.NewClient(conn, host)
+		return newClient(conn, host, false)
+	}
+	newLmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return newClient(conn, host, true)
 	}
 )
 
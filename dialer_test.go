@@ -1,11 +1,20 @@
 package mailx
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io"
+	"math/big"
 	"net"
 	"net/smtp"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestSmtpTlsLoginAuth(t *testing.T) {
@@ -53,6 +62,54 @@ func TestSmtpStarttlsCRAMMD5Auth(t *testing.T) {
 	testSmtp(t, false, m)
 }
 
+func TestSmtpAuthMechanism(t *testing.T) {
+	cert := tls.Certificate{Certificate: [][]byte{{0}}}
+
+	tests := []struct {
+		dialer *Dialer
+		auths  string
+		want   string
+		err    bool
+	}{
+		{&Dialer{}, "PLAIN", "", false},
+		{&Dialer{Username: "user"}, "LOGIN PLAIN CRAM-MD5", "CRAM-MD5", false},
+		{&Dialer{Username: "user"}, "LOGIN PLAIN", "PLAIN", false},
+		{&Dialer{Username: "user"}, "LOGIN", "LOGIN", false},
+		{&Dialer{Username: "user"}, "XOAUTH2", "", true},
+		{&Dialer{Username: "user", AuthMechanism: "login"}, "LOGIN PLAIN", "LOGIN", false},
+		{&Dialer{Username: "user", AuthMechanism: "LOGIN"}, "PLAIN", "", true},
+		{&Dialer{AuthMechanism: "EXTERNAL"}, "PLAIN EXTERNAL", "EXTERNAL", false},
+		{&Dialer{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}, "PLAIN EXTERNAL", "EXTERNAL", false},
+		{&Dialer{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}, "PLAIN", "", false},
+		{&Dialer{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}, "", "", false},
+	}
+
+	for i, tt := range tests {
+		ext := map[string]string{}
+		if tt.auths != "" {
+			ext["AUTH"] = tt.auths
+		}
+		auth, err := tt.dialer.smtpAuth(&mockSmtpClient{ext})
+		if tt.err {
+			if err == nil {
+				t.Fatalf("#%d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: smtpAuth err: %s", i, err.Error())
+		}
+
+		got := ""
+		if auth != nil {
+			got, _, _ = auth.Start(&smtp.ServerInfo{Name: tt.dialer.Host, TLS: true})
+		}
+		if got != tt.want {
+			t.Fatalf("#%d: invalid mechanism, got '%s', want '%s'", i, got, tt.want)
+		}
+	}
+}
+
 func testSmtp(t *testing.T, ssl bool, ext map[string]string) {
 
 	smtpUser := "user"
@@ -73,10 +130,15 @@ func testSmtp(t *testing.T, ssl bool, ext map[string]string) {
 		d.TLSConfig = &tls.Config{ServerName: d.Host}
 	}
 
-	netDial = func(*net.Dialer, string, string) (net.Conn, error) {
+	stubNetDial, stubTlsDial, stubNewSmtpClient := netDial, tlsDial, newSmtpClient
+	defer func() {
+		netDial, tlsDial, newSmtpClient = stubNetDial, stubTlsDial, stubNewSmtpClient
+	}()
+
+	netDial = func(context.Context, *net.Dialer, string, string) (net.Conn, error) {
 		return nil, nil
 	}
-	tlsDial = func(*tls.Dialer, string, string) (net.Conn, error) {
+	tlsDial = func(context.Context, *tls.Dialer, string, string) (net.Conn, error) {
 		return nil, nil
 	}
 	newSmtpClient = func(net.Conn, string) (smtpClient, error) {
@@ -107,6 +169,38 @@ func testSmtp(t *testing.T, ssl bool, ext map[string]string) {
 	}
 }
 
+func testCertificate(t *testing.T, hosts ...string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err.Error())
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     hosts,
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err.Error())
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %s", err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
 type mockSmtpClient struct {
 	ext map[string]string
 }
@@ -157,3 +251,72 @@ func (*mockWriter) Write(p []byte) (int, error) {
 func (*mockWriter) Close() error {
 	return nil
 }
+
+func TestDialConn(t *testing.T) {
+	d := &Dialer{
+		Host: "smtp.example.com",
+		Port: 25,
+
+		StartTLSPolicy: MandatoryStartTLS,
+	}
+
+	stubNewSmtpClient := newSmtpClient
+	defer func() { newSmtpClient = stubNewSmtpClient }()
+	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return &mockSmtpClient{map[string]string{}}, nil
+	}
+
+	c, s := net.Pipe()
+	defer s.Close()
+	if _, err := d.DialConn(c); err == nil {
+		t.Fatalf("expected error without STARTTLS")
+	}
+
+	d.StartTLSPolicy = NoStartTLS
+	ser, err := d.DialConn(c)
+	if err != nil {
+		t.Fatalf("DialConn: %s", err.Error())
+	}
+	ser.Close()
+}
+
+func TestDialUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "smtpd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix domain socket: %s", err.Error())
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writeGreeting(conn)
+	}()
+
+	d, err := ParseURL("unix://" + sock)
+	if err != nil {
+		t.Fatalf("ParseURL: %s", err.Error())
+	}
+	if s := d.String(); s != "unix://"+sock+"?tls=none" {
+		t.Fatalf("invalid string: %s", s)
+	}
+
+	stubNewSmtpClient := newSmtpClient
+	defer func() { newSmtpClient = stubNewSmtpClient }()
+	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		if host != "localhost" {
+			t.Fatalf("invalid server name, got '%s'", host)
+		}
+		readGreeting(t, conn)
+		return &mockSmtpClient{map[string]string{}}, nil
+	}
+
+	ser, err := d.Dial()
+	if err != nil {
+		t.Fatalf("dial: %s", err.Error())
+	}
+	ser.Close()
+}
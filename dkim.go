@@ -0,0 +1,453 @@
+package mailx
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// @author valor.
+
+// DKIMCanonicalization is the canonicalization algorithm of DKIM, see RFC 6376 - 3.4.
+type DKIMCanonicalization string
+
+const (
+	// DKIMSimple tolerates almost no modification of the message.
+	DKIMSimple DKIMCanonicalization = "simple"
+	// DKIMRelaxed tolerates the common modifications of whitespaces
+	// and the folding of the header fields.
+	DKIMRelaxed DKIMCanonicalization = "relaxed"
+)
+
+// dkimHeaders is the header fields signed by default, if present.
+var dkimHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// DKIMSigner signs the messages with DKIM, see RFC 6376.
+type DKIMSigner struct {
+	// Domain is the signing domain (d=), e.g. "example.com".
+	Domain string
+	// Selector is the selector (s=) of the public key,
+	// which is published at "<selector>._domainkey.<domain>".
+	Selector string
+	// Key is the private key, *rsa.PrivateKey for rsa-sha256,
+	// or ed25519.PrivateKey for ed25519-sha256 (RFC 8463).
+	Key crypto.Signer
+	// HeaderCanonicalization and BodyCanonicalization are the
+	// canonicalization algorithms (c=). If empty, DKIMRelaxed is used.
+	HeaderCanonicalization DKIMCanonicalization
+	BodyCanonicalization   DKIMCanonicalization
+	// Headers is the names of the header fields to sign (h=), if present.
+	// "From" is always signed. If nil, the common header fields are signed.
+	Headers []string
+	// Identity is the optional agent or user identifier (i=),
+	// e.g. "@example.com".
+	Identity string
+	// Expiration is the validity period of the signature (x=).
+	// If 0, the signature doesn't expire.
+	Expiration time.Duration
+}
+
+func (s *DKIMSigner) canonicalization() (DKIMCanonicalization, DKIMCanonicalization) {
+	h, b := s.HeaderCanonicalization, s.BodyCanonicalization
+	if h == "" {
+		h = DKIMRelaxed
+	}
+	if b == "" {
+		b = DKIMRelaxed
+	}
+	return h, b
+}
+
+func (s *DKIMSigner) algorithm() (string, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	}
+	return "", errors.New("unsupported DKIM key: only RSA and Ed25519 keys are supported")
+}
+
+func (s *DKIMSigner) headers() []string {
+	headers := s.Headers
+	if headers == nil {
+		headers = dkimHeaders
+	}
+	for _, k := range headers {
+		if strings.EqualFold(k, "From") {
+			return headers
+		}
+	}
+	return append([]string{"From"}, headers...)
+}
+
+// splitMessage splits the message into the raw header fields,
+// including their CRLF, and the body.
+func splitMessage(raw []byte) ([]string, []byte, error) {
+	i := bytes.Index(raw, []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil, nil, errors.New("invalid message: no end of header")
+	}
+	header, body := string(raw[:i+2]), raw[i+4:]
+
+	var fields []string
+	for len(header) > 0 {
+		end := strings.Index(header, "\r\n") + 2
+		// The continuation lines of a folded header field start with WSP.
+		for end < len(header) && (header[end] == ' ' || header[end] == '\t') {
+			end += strings.Index(header[end:], "\r\n") + 2
+		}
+		fields = append(fields, header[:end])
+		header = header[end:]
+	}
+	return fields, body, nil
+}
+
+func fieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return strings.TrimRight(field[:i], " \t")
+	}
+	return field
+}
+
+// compressWSP replaces the sequences of whitespaces with a single space.
+func compressWSP(s string) string {
+	b := &strings.Builder{}
+	wsp := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			b.WriteByte(' ')
+			wsp = false
+		}
+		b.WriteByte(c)
+	}
+	if wsp {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// canonicalHeader canonicalizes the raw header field, see RFC 6376 - 3.4.2.
+func canonicalHeader(c DKIMCanonicalization, field string) string {
+	if c == DKIMSimple {
+		return field
+	}
+	i := strings.IndexByte(field, ':')
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.NewReplacer("\r\n", "").Replace(field[i+1:])
+	value = strings.TrimSpace(compressWSP(value))
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBody canonicalizes the body, see RFC 6376 - 3.4.3 and 3.4.4.
+func canonicalBody(c DKIMCanonicalization, body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if c == DKIMRelaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(compressWSP(line), " ")
+		}
+	}
+	// Ignore the empty lines at the end of the body.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if c == DKIMRelaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func bodyHash(c DKIMCanonicalization, body []byte) string {
+	sum := sha256.Sum256(canonicalBody(c, body))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHash hashes the header fields named by h, and the DKIM-Signature
+// header field without its b= value, see RFC 6376 - 3.7.
+func headerHash(c DKIMCanonicalization, fields []string, names []string, sig string) []byte {
+	h := sha256.New()
+	// The instances of a header field are signed from the bottom up.
+	used := make(map[int]bool)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				io.WriteString(h, canonicalHeader(c, fields[i]))
+				break
+			}
+		}
+	}
+	io.WriteString(h, strings.TrimSuffix(canonicalHeader(c, sig), "\r\n"))
+	return h.Sum(nil)
+}
+
+// Sign signs the rendered message and returns the header field
+// 'DKIM-Signature' including its CRLF, to be prepended to the message.
+func (s *DKIMSigner) Sign(raw []byte) (string, error) {
+	if s.Domain == "" || s.Selector == "" {
+		return "", errors.New("empty DKIM domain or selector")
+	}
+	alg, err := s.algorithm()
+	if err != nil {
+		return "", err
+	}
+	fields, body, err := splitMessage(raw)
+	if err != nil {
+		return "", err
+	}
+	hc, bc := s.canonicalization()
+
+	// 'FROM' is always signed, so it must be present, see RFC 6376 - 5.4.
+	from := false
+	for _, field := range fields {
+		if strings.EqualFold(fieldName(field), "From") {
+			from = true
+		}
+	}
+	if !from {
+		return "", errors.New("no header field 'From' to sign with DKIM")
+	}
+
+	// Each instance of a header field is signed, e.g. several 'TO'.
+	var names []string
+	for _, k := range s.headers() {
+		for _, field := range fields {
+			if strings.EqualFold(fieldName(field), k) {
+				names = append(names, k)
+			}
+		}
+	}
+
+	now := time.Now()
+	tags := []string{
+		"v=1",
+		"a=" + alg,
+		"c=" + string(hc) + "/" + string(bc),
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+	}
+	if s.Identity != "" {
+		tags = append(tags, "i="+s.Identity)
+	}
+	tags = append(tags, "t="+strconv.FormatInt(now.Unix(), 10))
+	if s.Expiration > 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(s.Expiration).Unix(), 10))
+	}
+	tags = append(tags,
+		"h="+strings.ToLower(strings.Join(names, ":")),
+		"bh="+bodyHash(bc, body),
+		"b=",
+	)
+	sig := "DKIM-Signature: " + strings.Join(tags, ";\r\n\t") + "\r\n"
+
+	hash := headerHash(hc, fields, names, sig)
+	var b []byte
+	if alg == "rsa-sha256" {
+		b, err = s.Key.Sign(rand.Reader, hash, crypto.SHA256)
+	} else {
+		b, err = s.Key.Sign(rand.Reader, hash, crypto.Hash(0))
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(sig, "\r\n") + base64.StdEncoding.EncodeToString(b) + "\r\n", nil
+}
+
+// DKIMRecord returns the DNS TXT record of the public key,
+// e.g. "v=DKIM1; k=rsa; p=MIIBIjANBgkqh...".
+func DKIMRecord(pub crypto.PublicKey) (string, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key), nil
+	}
+	return "", errors.New("unsupported DKIM key: only RSA and Ed25519 keys are supported")
+}
+
+// parseDKIMTags parses the tag list, see RFC 6376 - 3.2.
+// The whitespaces are removed from the values.
+func parseDKIMTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		i := strings.IndexByte(tag, '=')
+		if i < 0 {
+			continue
+		}
+		value := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, tag[i+1:])
+		tags[strings.TrimSpace(tag[:i])] = value
+	}
+	return tags
+}
+
+// parseDKIMRecord parses the public key of the DNS TXT record.
+func parseDKIMRecord(record string) (crypto.PublicKey, error) {
+	tags := parseDKIMTags(record)
+	p, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(p) == 0 {
+		return nil, errors.New("invalid DKIM record: no public key")
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(p)
+		if err != nil {
+			return nil, errors.New("invalid DKIM record: " + err.Error())
+		}
+		if _, ok := pub.(*rsa.PublicKey); !ok {
+			return nil, errors.New("invalid DKIM record: not an RSA key")
+		}
+		return pub, nil
+	case "ed25519":
+		if len(p) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid DKIM record: invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(p), nil
+	}
+	return nil, errors.New("unsupported DKIM key type: " + tags["k"])
+}
+
+// stripSignature removes the value of the b= tag from the raw header field.
+func stripSignature(field string) string {
+	i := strings.IndexByte(field, ':') + 1
+	head, value := field[:i], field[i:]
+	tags := strings.Split(value, ";")
+	for j, tag := range tags {
+		k := strings.IndexByte(tag, '=')
+		if k >= 0 && strings.TrimSpace(tag[:k]) == "b" {
+			tags[j] = tag[:k+1]
+			if strings.HasSuffix(field, "\r\n") && j == len(tags)-1 {
+				tags[j] += "\r\n"
+			}
+		}
+	}
+	return head + strings.Join(tags, ";")
+}
+
+// VerifyDKIM verifies the DKIM-Signature header fields of the message,
+// e.g. in tests. The TXT records of "<selector>._domainkey.<domain>"
+// are looked up by lookupTXT, e.g. net.LookupTXT.
+// An error is returned if the message has no signature, or any
+// signature is invalid.
+func VerifyDKIM(r io.Reader, lookupTXT func(name string) ([]string, error)) error {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	fields, body, err := splitMessage(raw)
+	if err != nil {
+		return err
+	}
+
+	verified := 0
+	for _, field := range fields {
+		if !strings.EqualFold(fieldName(field), "DKIM-Signature") {
+			continue
+		}
+		if err = verifyDKIM(field, fields, body, lookupTXT); err != nil {
+			return err
+		}
+		verified++
+	}
+	if verified == 0 {
+		return errors.New("no DKIM signature")
+	}
+	return nil
+}
+
+func verifyDKIM(field string, fields []string, body []byte, lookupTXT func(string) ([]string, error)) error {
+	tags := parseDKIMTags(field[strings.IndexByte(field, ':')+1:])
+	if tags["v"] != "1" {
+		return errors.New("invalid DKIM signature: unsupported version: " + tags["v"])
+	}
+	if x, err := strconv.ParseInt(tags["x"], 10, 64); err == nil && time.Now().Unix() > x {
+		return errors.New("invalid DKIM signature: expired")
+	}
+
+	hc, bc := DKIMSimple, DKIMSimple
+	if c := tags["c"]; c != "" {
+		parts := strings.SplitN(c, "/", 2)
+		hc = DKIMCanonicalization(parts[0])
+		if len(parts) == 2 {
+			bc = DKIMCanonicalization(parts[1])
+		}
+	}
+	for _, c := range []DKIMCanonicalization{hc, bc} {
+		if c != DKIMSimple && c != DKIMRelaxed {
+			return errors.New("invalid DKIM signature: unsupported canonicalization: " + string(c))
+		}
+	}
+
+	if bodyHash(bc, body) != tags["bh"] {
+		return errors.New("invalid DKIM signature: body hash mismatch")
+	}
+
+	name := tags["s"] + "._domainkey." + tags["d"]
+	records, err := lookupTXT(name)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("no DKIM record: " + name)
+	}
+	pub, err := parseDKIMRecord(strings.Join(records, ""))
+	if err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return errors.New("invalid DKIM signature: " + err.Error())
+	}
+
+	names := strings.Split(tags["h"], ":")
+	hash := headerHash(hc, fields, names, stripSignature(field))
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return errors.New("invalid DKIM signature: algorithm mismatch: " + tags["a"])
+		}
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, b)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return errors.New("invalid DKIM signature: algorithm mismatch: " + tags["a"])
+		}
+		if !ed25519.Verify(key, hash, b) {
+			err = errors.New("verification error")
+		}
+	}
+	if err != nil {
+		return errors.New("invalid DKIM signature: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package mailx
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// RFC 6376 - 3.4.5
+	fields, body, err := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("split: %s", err.Error())
+	}
+	if len(fields) != 2 {
+		t.Fatalf("fields: %q", fields)
+	}
+
+	relaxed := canonicalHeader(DKIMRelaxed, fields[0]) + canonicalHeader(DKIMRelaxed, fields[1])
+	if relaxed != "a:X\r\nb:Y Z\r\n" {
+		t.Fatalf("relaxed header: %q", relaxed)
+	}
+	simple := canonicalHeader(DKIMSimple, fields[0]) + canonicalHeader(DKIMSimple, fields[1])
+	if simple != "A: X\r\nB : Y\t\r\n\tZ  \r\n" {
+		t.Fatalf("simple header: %q", simple)
+	}
+	if got := string(canonicalBody(DKIMRelaxed, body)); got != " C\r\nD E\r\n" {
+		t.Fatalf("relaxed body: %q", got)
+	}
+	if got := string(canonicalBody(DKIMSimple, body)); got != " C \r\nD \t E\r\n" {
+		t.Fatalf("simple body: %q", got)
+	}
+	if got := string(canonicalBody(DKIMSimple, nil)); got != "\r\n" {
+		t.Fatalf("simple empty body: %q", got)
+	}
+	if got := canonicalBody(DKIMRelaxed, []byte("\r\n")); len(got) != 0 {
+		t.Fatalf("relaxed empty body: %q", got)
+	}
+}
+
+func testDKIMLookup(t *testing.T, pub crypto.PublicKey) func(string) ([]string, error) {
+	record, err := DKIMRecord(pub)
+	if err != nil {
+		t.Fatalf("record: %s", err.Error())
+	}
+	return func(name string) ([]string, error) {
+		if name != "mail._domainkey.example.com" {
+			return nil, errors.New("no such host: " + name)
+		}
+		// Long records are split into strings of 255 octets.
+		var records []string
+		rest := record
+		for len(rest) > 255 {
+			records, rest = append(records, rest[:255]), rest[255:]
+		}
+		return append(records, rest), nil
+	}
+}
+
+func TestDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %s", err.Error())
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate Ed25519 key: %s", err.Error())
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		lookup := testDKIMLookup(t, key.Public())
+		for _, c := range [][2]DKIMCanonicalization{
+			{DKIMRelaxed, DKIMRelaxed},
+			{DKIMRelaxed, DKIMSimple},
+			{DKIMSimple, DKIMRelaxed},
+			{DKIMSimple, DKIMSimple},
+		} {
+			m := testTraceMessage()
+			m.SetDKIMSigner(&DKIMSigner{
+				Domain:   "example.com",
+				Selector: "mail",
+				Key:      key,
+
+				HeaderCanonicalization: c[0],
+				BodyCanonicalization:   c[1],
+			})
+			b := &bytes.Buffer{}
+			if _, err = m.WriteTo(b); err != nil {
+				t.Fatalf("write message: %s", err.Error())
+			}
+			raw := b.String()
+			if !strings.HasPrefix(raw, "DKIM-Signature: v=1;\r\n\t") {
+				t.Fatalf("message:\n%s", raw)
+			}
+			if err = VerifyDKIM(strings.NewReader(raw), lookup); err != nil {
+				t.Fatalf("verify %T %v: %s\n%s", key, c, err.Error(), raw)
+			}
+
+			// Refold a header field and add trailing whitespaces to the body.
+			modified := strings.Replace(raw, "SUBJECT: This is a subject", "SUBJECT: This is\r\n  a subject", 1)
+			modified = strings.TrimSuffix(modified, "\r\n") + " \r\n"
+			err = VerifyDKIM(strings.NewReader(modified), lookup)
+			if relaxed := c == [2]DKIMCanonicalization{DKIMRelaxed, DKIMRelaxed}; relaxed != (err == nil) {
+				t.Fatalf("verify modified %T %v: %v", key, c, err)
+			}
+
+			tampered := strings.Replace(raw, "SUBJECT: This is", "SUBJECT: That is", 1)
+			if err = VerifyDKIM(strings.NewReader(tampered), lookup); err == nil {
+				t.Fatalf("verify tampered %T %v: want error", key, c)
+			}
+		}
+	}
+
+	if err = VerifyDKIM(strings.NewReader("Subject: x\r\n\r\nbody"), nil); err == nil {
+		t.Fatal("verify unsigned: want error")
+	}
+}
+
+func TestDKIMHeaders(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	s := &DKIMSigner{Domain: "example.com", Selector: "mail", Key: key, Headers: []string{"Subject", "X-Missing"}}
+
+	raw := "FROM: <alex@example.com>\r\nSubject: x\r\nSubject: y\r\n\r\nbody\r\n"
+	sig, err := s.Sign([]byte(raw))
+	if err != nil {
+		t.Fatalf("sign: %s", err.Error())
+	}
+	if tags := parseDKIMTags(sig[strings.IndexByte(sig, ':')+1:]); tags["h"] != "from:subject:subject" {
+		t.Fatalf("h=%s", tags["h"])
+	}
+	if err = VerifyDKIM(strings.NewReader(sig+raw), testDKIMLookup(t, key.Public())); err != nil {
+		t.Fatalf("verify: %s", err.Error())
+	}
+
+	// RFC 6376 - 5.4
+	if _, err = s.Sign([]byte("Subject: x\r\n\r\nbody\r\n")); err == nil {
+		t.Fatal("sign without From: want error")
+	}
+
+	s.Key = nil
+	if _, err = s.Sign([]byte(raw)); err == nil {
+		t.Fatal("sign without key: want error")
+	}
+}
+
+// testRFC8463 is the signed message of RFC 8463 - Appendix A.
+const testRFC8463 = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func TestDKIMRFC8463(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	key := ed25519.NewKeyFromSeed(seed)
+	lookup := func(name string) ([]string, error) {
+		if name != "brisbane._domainkey.football.example.com" {
+			return nil, errors.New("no such host: " + name)
+		}
+		return []string{"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}, nil
+	}
+	if record, _ := DKIMRecord(key.Public()); record != "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=" {
+		t.Fatalf("record: %s", record)
+	}
+	if err := VerifyDKIM(strings.NewReader(testRFC8463), lookup); err != nil {
+		t.Fatalf("verify: %s", err.Error())
+	}
+
+	// Ed25519 is deterministic, so the header hash of the signature
+	// of the RFC is signed to its b= exactly.
+	fields, body, err := splitMessage([]byte(testRFC8463))
+	if err != nil {
+		t.Fatalf("split: %s", err.Error())
+	}
+	names := []string{"from", "to", "subject", "date", "message-id", "from", "subject", "date"}
+	b := ed25519.Sign(key, headerHash(DKIMRelaxed, fields[1:], names, stripSignature(fields[0])))
+	if got := base64.StdEncoding.EncodeToString(b); got != "/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==" {
+		t.Fatalf("b=%s", got)
+	}
+
+	s := &DKIMSigner{Domain: "football.example.com", Selector: "brisbane", Key: key}
+	raw := strings.Join(fields[1:], "") + "\r\n" + string(body)
+	sig, err := s.Sign([]byte(raw))
+	if err != nil {
+		t.Fatalf("sign: %s", err.Error())
+	}
+	if err = VerifyDKIM(strings.NewReader(sig+raw), lookup); err != nil {
+		t.Fatalf("verify signed: %s", err.Error())
+	}
+	tags := parseDKIMTags(sig[strings.IndexByte(sig, ':')+1:])
+	if tags["bh"] != "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=" || tags["h"] != "from:subject:date:to:message-id" {
+		t.Fatalf("bh=%s h=%s", tags["bh"], tags["h"])
+	}
+}
@@ -1,6 +1,7 @@
 package mailx
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/mail"
@@ -99,3 +100,53 @@ func SampleDaemon() {
 	// Close the channel to stop the mail daemon.
 	close(ch)
 }
+
+func SampleQueue() {
+	const (
+		smtpHost = "smtp.example.com"
+		smtpPort = 465
+		username = "user"
+		password = "123456"
+
+		sslOnConnect = true
+	)
+
+	q := &Queue{
+		Dir: "/var/spool/mailx",
+		Dialer: &Dialer{
+			Host: smtpHost,
+			Port: smtpPort,
+
+			Username: username,
+			Password: password,
+
+			SSLOnConnect: sslOnConnect,
+		},
+		Concurrency: 4,
+	}
+
+	// Deliver the queued emails in the background,
+	// including the ones left by the last run.
+	ctx, cancel := context.WithCancel(context.Background())
+	go q.Run(ctx)
+
+	m := NewMessage()
+	m.SetTo("bob@example.com")
+	m.SetSubject("This is a subject of email.")
+	m.SetPlainBody("This is a text/plain body.")
+	if _, err := q.Enqueue(m); err != nil {
+		panic(err)
+	}
+
+	// The permanently failed emails can be inspected.
+	dead, err := q.Dead()
+	if err != nil {
+		panic(err)
+	}
+	for _, item := range dead {
+		fmt.Printf("%s: %s\n", item.ID, item.Attempts[len(item.Attempts)-1].Err)
+	}
+
+	// Cancel the context to stop the queue.
+	cancel()
+}
@@ -14,11 +14,20 @@ type file struct {
 	// If true, the file is attachment.
 	// If false, the file is embedded.
 	attachment bool
+	// ctype is the 'Content-Type' of the file.
+	// If empty, it is guessed from the extension of the filename.
+	ctype string
+	// encoding is the 'Content-Transfer-Encoding' of the file,
+	// which is written as is. If empty, the file is encoded by base64.
+	encoding string
 
 	copier CopyFunc
 }
 
 func (f *file) contentType() string {
+	if f.ctype != "" {
+		return f.ctype
+	}
 	mediaType := mime.TypeByExtension(filepath.Ext(f.filename))
 	if mediaType == "" {
 		mediaType = "application/octet-stream"
@@ -26,6 +35,21 @@ func (f *file) contentType() string {
 	return mediaType
 }
 
+// sevenBit returns the file to be written in 7bit, that is, the file
+// in 8bit is encoded by base64. Since 'message/rfc822' must not be
+// encoded (RFC 2046 - 5.2.1), it is written as 'application/octet-stream'.
+func (f *file) sevenBit() *file {
+	if f.encoding != "8bit" {
+		return f
+	}
+	c := *f
+	c.encoding = ""
+	if c.ctype == "message/rfc822" {
+		c.ctype = "application/octet-stream"
+	}
+	return &c
+}
+
 func (f *file) disposition() string {
 	disp := ""
 	if f.attachment {
@@ -0,0 +1,110 @@
+package mailx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// @author valor.
+
+const (
+	fileDropMsgExt      = ".eml"
+	fileDropEnvelopeExt = ".json"
+)
+
+// FileEnvelope is the envelope of an email dropped by FileTransport.
+type FileEnvelope struct {
+	// From is the envelope sender.
+	From string `json:"from"`
+	// Rcpt is the envelope recipients.
+	Rcpt []string `json:"rcpt"`
+	// Created is the time when the email was dropped.
+	Created time.Time `json:"created"`
+}
+
+// FileTransport writes each email as a .eml file to a directory
+// instead of sending it, e.g. for local development.
+//
+// The files are named by the time they are dropped, so that they
+// are listed in order, e.g. "20240511T080000.000000000-1f2e3d4c.eml".
+// Each file is written atomically, by renaming a temporary file.
+type FileTransport struct {
+	// Dir is the directory of the files. It is created if not exists.
+	Dir string
+	// EnvelopeHeaders defines whether the envelope is written as the
+	// headers "X-Envelope-From" and "X-Envelope-To" before the message.
+	// If false, the envelope is written to a sidecar .json file
+	// of the same name, see FileEnvelope.
+	EnvelopeHeaders bool
+}
+
+// Drop writes the email to the directory and returns the path of its file.
+func (t *FileTransport) Drop(m *Message) (string, error) {
+	from, _ := m.sender()
+	rcpt, err := m.rcpt()
+	if err != nil {
+		return "", err
+	}
+	if t.EnvelopeHeaders {
+		// Do not let the addresses break the headers.
+		for _, addr := range append([]string{from}, rcpt...) {
+			if strings.ContainsAny(addr, "\r\n") {
+				return "", errors.New("invalid email address: " + addr)
+			}
+		}
+	}
+	if err = os.MkdirAll(t.Dir, 0700); err != nil {
+		return "", err
+	}
+
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	name := filepath.Join(t.Dir, now.UTC().Format("20060102T150405.000000000")+"-"+id[:8])
+
+	if !t.EnvelopeHeaders {
+		env := &FileEnvelope{From: from, Rcpt: rcpt, Created: now}
+		err = writeFileAtomic(name+fileDropEnvelopeExt, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(env)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = writeFileAtomic(name+fileDropMsgExt, func(w io.Writer) error {
+		if t.EnvelopeHeaders {
+			header := "X-Envelope-From: <" + from + ">\r\n" +
+				"X-Envelope-To: <" + strings.Join(rcpt, ">,\r\n <") + ">\r\n"
+			if _, err := io.WriteString(w, header); err != nil {
+				return err
+			}
+		}
+		_, err := m.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		os.Remove(name + fileDropEnvelopeExt)
+		return "", err
+	}
+	return name + fileDropMsgExt, nil
+}
+
+// Send implements Transport.
+func (t *FileTransport) Send(ctx context.Context, m *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := t.Drop(m)
+	return err
+}
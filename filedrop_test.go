@@ -0,0 +1,64 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "drop")
+	tr := &FileTransport{Dir: dir}
+
+	name, err := tr.Drop(testTraceMessage())
+	if err != nil {
+		t.Fatalf("drop: %s", err.Error())
+	}
+	if filepath.Dir(name) != dir || !strings.HasSuffix(name, ".eml") {
+		t.Fatalf("name: %s", name)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+	if !bytes.Contains(data, []byte("SUBJECT: This is a subject of email.\r\n")) {
+		t.Fatalf("message:\n%s", data)
+	}
+
+	b, err := ioutil.ReadFile(strings.TrimSuffix(name, ".eml") + ".json")
+	if err != nil {
+		t.Fatalf("read envelope: %s", err.Error())
+	}
+	env := &FileEnvelope{}
+	if err = json.Unmarshal(b, env); err != nil {
+		t.Fatalf("decode envelope: %s", err.Error())
+	}
+	if env.From != "alex@example.com" || len(env.Rcpt) != 1 || env.Rcpt[0] != "aaa@example.com" {
+		t.Fatalf("envelope: %+v", env)
+	}
+
+	tr.EnvelopeHeaders = true
+	m := testTraceMessage()
+	m.AddTo("bbb@example.com")
+	if err = tr.Send(context.Background(), m); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 3 {
+		t.Fatalf("files: %v", files)
+	}
+	// The files are listed in order.
+	data, err = ioutil.ReadFile(files[2])
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+	want := "X-Envelope-From: <alex@example.com>\r\n" +
+		"X-Envelope-To: <aaa@example.com>,\r\n <bbb@example.com>\r\n"
+	if !strings.HasPrefix(string(data), want) {
+		t.Fatalf("message:\n%s", data)
+	}
+}
@@ -0,0 +1,87 @@
+package mailx
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"strings"
+)
+
+// @author valor.
+
+const forwardSeparator = "---------- Forwarded message ----------"
+
+// formatAddress formats the address for reading, without encoding its name.
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return "<" + addr.Address + ">"
+	}
+	return addr.Name + " <" + addr.Address + ">"
+}
+
+func formatAddresses(list []*mail.Address) string {
+	s := make([]string, 0, len(list))
+	for _, addr := range list {
+		s = append(s, formatAddress(addr))
+	}
+	return strings.Join(s, ", ")
+}
+
+// AddForwardBody adds a text part of the body of email message,
+// which quotes the headers and the text body of the email message,
+// e.g. to forward it inline. The text body is the first 'text/plain'
+// part of the email message, see ReadMessage.
+//
+// If the subject of email message is empty,
+// it is set to "Fwd: " and the subject of the forwarded one.
+func (m *Message) AddForwardBody(raw io.Reader) error {
+	orig, err := ReadMessage(raw)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	if orig.header.from != nil {
+		lines = append(lines, "From: "+formatAddress(orig.header.from))
+	}
+	if orig.header.datefmt != "" {
+		lines = append(lines, "Date: "+orig.header.datefmt)
+	}
+	lines = append(lines, "Subject: "+orig.header.subject)
+	if len(orig.header.to) > 0 {
+		lines = append(lines, "To: "+formatAddresses(orig.header.to))
+	}
+	if len(orig.header.cc) > 0 {
+		lines = append(lines, "Cc: "+formatAddresses(orig.header.cc))
+	}
+	lines = append(lines, "")
+
+	for _, p := range orig.parts {
+		if p.ctype != "text/plain" {
+			continue
+		}
+		b := &bytes.Buffer{}
+		if _, err = p.copier(b); err != nil {
+			return err
+		}
+		text := strings.TrimRight(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n")
+		lines = append(lines, strings.Split(text, "\n")...)
+		break
+	}
+
+	body := &strings.Builder{}
+	body.WriteString(forwardSeparator + "\r\n")
+	for _, line := range lines {
+		if line == "" {
+			body.WriteString(">\r\n")
+		} else {
+			body.WriteString("> " + line + "\r\n")
+		}
+	}
+	m.AddPlainBody(body.String())
+
+	if m.header.subject == "" {
+		m.header.subject = "Fwd: " + orig.header.subject
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package mailx
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+const testForwarded = "From: Spammer <spam@example.net>\n" +
+	"To: alex@example.com\n" +
+	"Date: Wed, 01 May 2024 08:00:00 +0000\n" +
+	"Subject: =?utf-8?q?Gro=C3=9Fer_Gewinn?=\n" +
+	"\n" +
+	"You won!\n" +
+	".\n" +
+	"Click here.\n"
+
+func TestAttachMessage(t *testing.T) {
+	for _, tt := range []struct {
+		raw, encoding string
+	}{
+		{testForwarded, "7bit"},
+		{testForwarded + "Grüße\n", "8bit"},
+	} {
+		m := testTraceMessage()
+		m.AttachMessage("report.eml", strings.NewReader(tt.raw))
+
+		b := &bytes.Buffer{}
+		if _, err := m.WriteTo(b); err != nil {
+			t.Fatalf("write message: %s", err.Error())
+		}
+		s := b.String()
+		want := "Content-Type: message/rfc822\r\n" +
+			"Content-Disposition: attachment; filename=\"report.eml\"\r\n" +
+			"Content-Transfer-Encoding: " + tt.encoding + "\r\n" +
+			"\r\n" +
+			strings.ReplaceAll(tt.raw, "\n", "\r\n") +
+			"\r\n--"
+		if !strings.Contains(s, want) {
+			t.Fatalf("missing %q in message:\n%s", want, s)
+		}
+
+		read, err := ReadMessage(b)
+		if err != nil {
+			t.Fatalf("read message: %s", err.Error())
+		}
+		if len(read.files) != 1 || read.files[0].ctype != "message/rfc822" || read.files[0].encoding != tt.encoding {
+			t.Fatalf("files: %+v", read.files)
+		}
+		raw := &bytes.Buffer{}
+		read.files[0].copier(raw)
+		if raw.String() != strings.ReplaceAll(tt.raw, "\n", "\r\n") {
+			t.Fatalf("read attached message: %q", raw.String())
+		}
+	}
+
+	m := testTraceMessage()
+	m.AttachMessage("long.eml", strings.NewReader(strings.Repeat("x", maxRawLineLength+1)))
+	if _, err := m.WriteTo(io.Discard); err == nil {
+		t.Fatal("write message: want error of long line")
+	}
+}
+
+func TestAddForwardBody(t *testing.T) {
+	m := NewMessage()
+	m.SetSender("abuse@example.com")
+	m.SetTo("noc@example.com")
+	m.SetPlainBody("Please see the report below.\r\n")
+	if err := m.AddForwardBody(strings.NewReader(testForwarded)); err != nil {
+		t.Fatalf("forward: %s", err.Error())
+	}
+
+	if m.header.subject != "Fwd: Großer Gewinn" {
+		t.Fatalf("subject: %q", m.header.subject)
+	}
+	if len(m.parts) != 2 {
+		t.Fatalf("parts: %d, want 2", len(m.parts))
+	}
+	b := &bytes.Buffer{}
+	m.parts[1].copier(b)
+	want := "---------- Forwarded message ----------\r\n" +
+		"> From: Spammer <spam@example.net>\r\n" +
+		"> Date: Wed, 01 May 2024 08:00:00 +0000\r\n" +
+		"> Subject: Großer Gewinn\r\n" +
+		"> To: <alex@example.com>\r\n" +
+		">\r\n" +
+		"> You won!\r\n" +
+		"> .\r\n" +
+		"> Click here.\r\n"
+	if b.String() != want {
+		t.Fatalf("got:\n%q\nwant:\n%q", b.String(), want)
+	}
+	if _, err := m.WriteTo(io.Discard); err != nil {
+		t.Fatalf("write message: %s", err.Error())
+	}
+}
+
+// testDataClient captures the message sent by DATA.
+type testDataClient struct {
+	mockSmtpClient
+	data *bytes.Buffer
+}
+
+func (c *testDataClient) Data() (io.WriteCloser, error) {
+	c.data = &bytes.Buffer{}
+	return nopWriteCloser{c.data}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestAttachMessage8BitMIME(t *testing.T) {
+	raw := testForwarded + "Grüße\n"
+	for _, ext := range []map[string]string{{"8BITMIME": ""}, {}} {
+		c := &testDataClient{mockSmtpClient: mockSmtpClient{ext}}
+		s := &Sender{smtpClient: c}
+		m := testTraceMessage()
+		m.SetSender("alex@example.com")
+		m.SetTo("aaa@example.com")
+		m.AttachMessage("report.eml", strings.NewReader(raw))
+		if _, err := s.SendWithReceipt(m); err != nil {
+			t.Fatalf("send: %s", err.Error())
+		}
+
+		// Without 8BITMIME, the message is encoded by base64.
+		want := "Content-Type: message/rfc822\r\n" +
+			"Content-Disposition: attachment; filename=\"report.eml\"\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n"
+		if len(ext) == 0 {
+			want = "Content-Type: application/octet-stream\r\n" +
+				"Content-Disposition: attachment; filename=\"report.eml\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n"
+		}
+		if !strings.Contains(c.data.String(), want) {
+			t.Fatalf("missing %q in message:\n%s", want, c.data)
+		}
+
+		read, err := ReadMessage(c.data)
+		if err != nil {
+			t.Fatalf("read message: %s", err.Error())
+		}
+		b := &bytes.Buffer{}
+		read.files[0].copier(b)
+		if b.String() != strings.ReplaceAll(raw, "\n", "\r\n") {
+			t.Fatalf("read attached message: %q", b.String())
+		}
+	}
+}
@@ -3,3 +3,5 @@ module github.com/valord577/mailx
 go 1.16
 
 retract v0.1.20211112
+
+require github.com/ProtonMail/go-crypto v1.1.6
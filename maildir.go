@@ -0,0 +1,110 @@
+package mailx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// @author valor.
+
+// maildirCount makes the names of the files unique within the process.
+var maildirCount uint64
+
+// MaildirTransport delivers each email as a file to a Maildir,
+// e.g. to archive a copy of the emails sent, see TeeTransport.
+//
+// The file is written to "tmp" and then renamed to "new",
+// so that readers of the Maildir never see a partial message.
+// The message is written with the local LF line endings.
+type MaildirTransport struct {
+	// Dir is the directory of the Maildir.
+	// Its subdirectories "tmp", "new" and "cur" are created if not exist.
+	Dir string
+}
+
+// maildirName returns a unique name of a file in the Maildir,
+// e.g. "1715414400.M123456P4242Q1R1f2e3d4c5b6a7988.host".
+func maildirName() (string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	// The characters '/' and ':' are not allowed in the name.
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	now := time.Now()
+	return strconv.FormatInt(now.Unix(), 10) +
+		".M" + strconv.Itoa(now.Nanosecond()/1000) +
+		"P" + strconv.Itoa(os.Getpid()) +
+		"Q" + strconv.FormatUint(atomic.AddUint64(&maildirCount, 1), 10) +
+		"R" + hex.EncodeToString(buf[:]) +
+		"." + host, nil
+}
+
+func (t *MaildirTransport) init() error {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.Dir, dir), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deliver writes the email to the Maildir and returns the path of its file in "new".
+func (t *MaildirTransport) Deliver(m *Message) (string, error) {
+	if err := t.init(); err != nil {
+		return "", err
+	}
+	name, err := maildirName()
+	if err != nil {
+		return "", err
+	}
+
+	tmp := filepath.Join(t.Dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	lw := &lfWriter{w: f}
+	if _, err = m.WriteTo(lw); err == nil {
+		err = lw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	path := filepath.Join(t.Dir, "new", name)
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+// Send implements Transport.
+func (t *MaildirTransport) Send(ctx context.Context, m *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := t.Deliver(m)
+	return err
+}
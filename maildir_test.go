@@ -0,0 +1,118 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaildirTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	tr := &MaildirTransport{Dir: dir}
+
+	names := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		path, err := tr.Deliver(testTraceMessage())
+		if err != nil {
+			t.Fatalf("deliver: %s", err.Error())
+		}
+		if filepath.Dir(path) != filepath.Join(dir, "new") || names[path] {
+			t.Fatalf("path: %s", path)
+		}
+		names[path] = true
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read: %s", err.Error())
+		}
+		if bytes.Contains(data, []byte("\r\n")) || !bytes.Contains(data, []byte("SUBJECT: This is a subject of email.\n")) {
+			t.Fatalf("message:\n%s", data)
+		}
+	}
+
+	for _, sub := range []string{"tmp", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil || len(files) != 0 {
+			t.Fatalf("%s: %v, %d files", sub, err, len(files))
+		}
+	}
+}
+
+func TestTeeTransport(t *testing.T) {
+	sent, archive := &MemoryTransport{}, &MemoryTransport{}
+	tr := &TeeTransport{Transport: sent, Copies: []Transport{archive}}
+	if err := tr.Send(context.Background(), testTraceMessage()); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+	if len(sent.Messages()) != 1 || len(archive.Messages()) != 1 {
+		t.Fatalf("messages: %d sent, %d archived", len(sent.Messages()), len(archive.Messages()))
+	}
+
+	// The copies are exactly the message sent.
+	if !bytes.Equal(sent.Messages()[0].Data, archive.Messages()[0].Data) {
+		t.Fatalf("sent:\n%s\narchived:\n%s", sent.Messages()[0].Data, archive.Messages()[0].Data)
+	}
+
+	// The file of the Maildir is in the way of its subdirectories.
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("write: %s", err.Error())
+	}
+	tr.Copies = append(tr.Copies, &MaildirTransport{Dir: file})
+	err := tr.Send(context.Background(), testTraceMessage())
+	var copyErr *CopyError
+	if !errors.As(err, &copyErr) || len(copyErr.Errs) != 1 || IsTemporary(err) {
+		t.Fatalf("send: %v", err)
+	}
+	if len(sent.Messages()) != 2 || len(archive.Messages()) != 2 {
+		t.Fatalf("messages: %d sent, %d archived", len(sent.Messages()), len(archive.Messages()))
+	}
+}
+
+func TestTeeTransportSMTP(t *testing.T) {
+	c := &testDataClient{mockSmtpClient: mockSmtpClient{map[string]string{}}}
+	stubNewSmtpClient := newSmtpClient
+	defer func() { newSmtpClient = stubNewSmtpClient }()
+	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return c, nil
+	}
+	d := &Dialer{
+		Host: "smtp.example.com",
+		Port: 587,
+		NetDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, nil
+		},
+	}
+
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	tr := &TeeTransport{Transport: d, Copies: []Transport{&MaildirTransport{Dir: dir}}}
+	m := testTraceMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com")
+	m.SetPGPSigner(&testPGP{})
+	if err := tr.Send(context.Background(), m); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("new: %v, %d files", err, len(files))
+	}
+	archived, err := ioutil.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+	// The Maildir is written with LF.
+	sent := c.data.Bytes()
+	if !bytes.Equal(bytes.ReplaceAll(sent, []byte("\r\n"), []byte("\n")), archived) {
+		t.Fatalf("sent:\n%s\narchived:\n%s", sent, archived)
+	}
+	if m.MessageID() != "" {
+		t.Fatalf("message is modified: %s", m.MessageID())
+	}
+}
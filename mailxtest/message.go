@@ -0,0 +1,153 @@
+package mailxtest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// @author valor.
+
+// Message is a message captured by the Server.
+type Message struct {
+	// Helo is the host name sent by EHLO or HELO.
+	Helo string
+	// User is the authenticated user, if any.
+	User string
+	// TLS reports whether the message was sent over TLS.
+	TLS bool
+	// From and To are the envelope sender and recipients.
+	From string
+	To   []string
+	// QueueID is the queue ID in the reply to the final dot of DATA.
+	QueueID string
+	// Data is the message as sent after DATA, with CRLF line endings.
+	Data []byte
+
+	// Header is the parsed header of Data,
+	// or nil if Data is not a valid RFC 5322 message.
+	Header mail.Header
+	// Body is the raw body of Data after the header.
+	Body []byte
+}
+
+// Part is a decoded leaf part of a MIME message.
+type Part struct {
+	// MediaType is the media type of the part, e.g. "text/plain".
+	MediaType string
+	// Params is the parameters of the Content-Type, e.g. "charset".
+	Params map[string]string
+	// Header is the header of the part.
+	Header textproto.MIMEHeader
+	// Body is the body of the part, decoded from the transfer encoding.
+	Body []byte
+}
+
+// Filename returns the file name of an attachment or an inline file.
+func (p *Part) Filename() string {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+func (m *Message) parse() {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return
+	}
+	m.Header, m.Body = msg.Header, body
+}
+
+// Subject returns the decoded subject of the message.
+func (m *Message) Subject() string {
+	if m.Header == nil {
+		return ""
+	}
+	subject := m.Header.Get("Subject")
+	if s, err := (&mime.WordDecoder{}).DecodeHeader(subject); err == nil {
+		return s
+	}
+	return subject
+}
+
+// Parts walks the multipart tree of the message,
+// and returns the decoded leaf parts in order.
+func (m *Message) Parts() ([]*Part, error) {
+	if m.Header == nil {
+		_, err := mail.ReadMessage(bytes.NewReader(m.Data))
+		return nil, err
+	}
+	return walkParts(textproto.MIMEHeader(m.Header), bytes.NewReader(m.Body), nil)
+}
+
+// Part returns the first leaf part of the media type, or nil if not found.
+func (m *Message) Part(mediaType string) (*Part, error) {
+	parts, err := m.Parts()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		if strings.EqualFold(p.MediaType, mediaType) {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+func walkParts(header textproto.MIMEHeader, body io.Reader, parts []*Part) ([]*Part, error) {
+	mediaType, params := "text/plain", map[string]string{"charset": "us-ascii"}
+	if ct := header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return nil, err
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextPart()
+			if err == io.EOF {
+				return parts, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if parts, err = walkParts(p.Header, p, parts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The multipart reader decodes quoted-printable itself
+	// and removes the Content-Transfer-Encoding header.
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return append(parts, &Part{
+		MediaType: mediaType,
+		Params:    params,
+		Header:    header,
+		Body:      b,
+	}), nil
+}
@@ -0,0 +1,723 @@
+// Package mailxtest provides an in-process SMTP server for testing
+// the emails sent by mailx.
+package mailxtest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valord577/mailx"
+)
+
+// @author valor.
+
+// Failure injects a reply to the matching command of the client.
+type Failure struct {
+	// Command is the verb of the command, e.g. "RCPT".
+	// The special commands are "CONNECT" for the greeting,
+	// and "." for the final dot of DATA.
+	Command string
+	// Arg is matched as a case-insensitive substring of the arguments,
+	// e.g. "<bob@example.com>". If empty, any arguments match.
+	Arg string
+	// Code and Msg are the reply, e.g. 550 and "5.1.1 User unknown".
+	// If Code is 0, no reply is sent.
+	Code int
+	Msg  string
+	// Times is the number of times to inject the failure.
+	// If 0, it is injected every time.
+	Times int
+	// Disconnect closes the connection after the reply.
+	Disconnect bool
+}
+
+// Server is an SMTP server listening on a loopback address,
+// which captures the messages sent to it.
+//
+// The fields must be set before Start.
+type Server struct {
+	// Addr is the address of the listener, e.g. "127.0.0.1:49152".
+	// It is set by Start.
+	Addr string
+
+	// Domain is the host name in the greeting and the reply to EHLO.
+	// If empty, "localhost" is used.
+	Domain string
+	// SSLOnConnect defines whether the connections are TLS from the start.
+	SSLOnConnect bool
+	// StartTLS defines whether the STARTTLS extension is supported.
+	StartTLS bool
+	// RequireTLS rejects the mail transactions before STARTTLS.
+	RequireTLS bool
+	// Auth is the advertised SASL mechanisms: "PLAIN", "LOGIN" or "CRAM-MD5".
+	Auth []string
+	// Users is the passwords of the users to authenticate.
+	// If nil, any credentials are accepted.
+	Users map[string]string
+	// RequireAuth rejects the mail transactions before authentication.
+	RequireAuth bool
+	// Size is the maximum size of messages advertised by the SIZE extension.
+	// If 0, the SIZE extension is not supported.
+	Size int
+	// Pipelining defines whether the PIPELINING extension is advertised.
+	Pipelining bool
+	// EightBitMIME defines whether the 8BITMIME extension is advertised.
+	EightBitMIME bool
+
+	// cert is the generated certificate for STARTTLS and SSLOnConnect.
+	cert *tls.Certificate
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	messages []*Message
+	failures []*Failure
+	queued   int
+}
+
+// NewServer starts and returns a new Server
+// supporting the PIPELINING and 8BITMIME extensions.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Pipelining = true
+	s.EightBitMIME = true
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new Server but doesn't start it.
+// After changing its configuration, the caller should call Start.
+func NewUnstartedServer() *Server {
+	return &Server{}
+}
+
+// Start starts the server on a loopback address.
+// It panics if the server cannot listen.
+func (s *Server) Start() {
+	if s.listener != nil {
+		panic("mailxtest: Server already started")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic("mailxtest: failed to listen on a port: " + err.Error())
+		}
+	}
+	if s.SSLOnConnect || s.StartTLS {
+		if s.cert, err = newCertificate(); err != nil {
+			l.Close()
+			panic("mailxtest: failed to generate certificate: " + err.Error())
+		}
+	}
+
+	s.listener = l
+	s.Addr = l.Addr().String()
+	s.conns = make(map[net.Conn]struct{})
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close shuts down the server and closes the connections of the clients.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed || s.listener == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.listener.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// Certificate returns the generated certificate of the server,
+// or nil if neither StartTLS nor SSLOnConnect is set.
+func (s *Server) Certificate() *x509.Certificate {
+	if s.cert == nil {
+		return nil
+	}
+	return s.cert.Leaf
+}
+
+// TLSConfig returns the TLS configuration of a client,
+// which trusts the certificate of the server.
+func (s *Server) TLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	if s.cert != nil {
+		pool.AddCert(s.cert.Leaf)
+	}
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return &tls.Config{ServerName: host, RootCAs: pool}
+}
+
+// Dialer returns a Dialer to the server. STARTTLS is mandatory
+// if the server supports it, and the certificate is trusted.
+func (s *Server) Dialer() *mailx.Dialer {
+	host, port, _ := net.SplitHostPort(s.Addr)
+	p, _ := strconv.Atoi(port)
+
+	d := &mailx.Dialer{
+		Host:      host,
+		Port:      p,
+		TLSConfig: s.TLSConfig(),
+
+		SSLOnConnect:   s.SSLOnConnect,
+		StartTLSPolicy: mailx.NoStartTLS,
+	}
+	if s.StartTLS {
+		d.StartTLSPolicy = mailx.MandatoryStartTLS
+	}
+	return d
+}
+
+// Fail injects the failure into the following sessions.
+func (s *Server) Fail(f Failure) {
+	s.mu.Lock()
+	s.failures = append(s.failures, &f)
+	s.mu.Unlock()
+}
+
+// Messages returns the captured messages in order.
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message(nil), s.messages...)
+}
+
+// Reset removes the captured messages and the injected failures.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.messages = nil
+	s.failures = nil
+	s.mu.Unlock()
+}
+
+func (s *Server) domain() string {
+	if s.Domain == "" {
+		return "localhost"
+	}
+	return s.Domain
+}
+
+func (s *Server) tlsConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{*s.cert}}
+}
+
+// failure returns the failure to inject into the command, if any.
+func (s *Server) failure(verb, arg string) *Failure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	arg = strings.ToLower(arg)
+	for i, f := range s.failures {
+		if !strings.EqualFold(f.Command, verb) || !strings.Contains(arg, strings.ToLower(f.Arg)) {
+			continue
+		}
+		if f.Times > 0 {
+			if f.Times--; f.Times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// capture captures the message and returns its queue ID.
+func (s *Server) capture(m *Message) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queued++
+	m.QueueID = fmt.Sprintf("%08X", s.queued)
+	s.messages = append(s.messages, m)
+	return m.QueueID
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			sess := &session{s: s, conn: conn}
+			sess.serve()
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			sess.conn.Close()
+		}()
+	}
+}
+
+// session is an SMTP session with a client.
+type session struct {
+	s    *Server
+	conn net.Conn
+	text *textproto.Conn
+	tls  bool
+
+	helo string
+	user string
+
+	mail bool
+	from string
+	rcpt []string
+}
+
+func (c *session) reply(code int, msg string) error {
+	return c.text.PrintfLine("%d %s", code, msg)
+}
+
+// inject replies the failure to the command, if any,
+// and reports whether the session should stop.
+func (c *session) inject(verb, arg string) (injected, stop bool) {
+	f := c.s.failure(verb, arg)
+	if f == nil {
+		return false, false
+	}
+	if f.Code != 0 {
+		if err := c.reply(f.Code, f.Msg); err != nil {
+			return true, true
+		}
+	}
+	return true, f.Disconnect
+}
+
+func (c *session) reset() {
+	c.mail, c.from, c.rcpt = false, "", nil
+}
+
+func (c *session) serve() {
+	if c.s.SSLOnConnect {
+		tc := tls.Server(c.conn, c.s.tlsConfig())
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		c.conn, c.tls = tc, true
+	}
+	c.text = textproto.NewConn(c.conn)
+
+	if injected, stop := c.inject("CONNECT", ""); injected {
+		if stop {
+			return
+		}
+	} else if err := c.reply(220, c.s.domain()+" ESMTP mailxtest"); err != nil {
+		return
+	}
+
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		verb = strings.ToUpper(verb)
+
+		if injected, stop := c.inject(verb, arg); injected {
+			if stop {
+				return
+			}
+			continue
+		}
+		if err = c.handle(verb, arg); err != nil {
+			return
+		}
+		if verb == "QUIT" {
+			return
+		}
+	}
+}
+
+func (c *session) handle(verb, arg string) error {
+	switch verb {
+	case "EHLO", "HELO", "QUIT", "NOOP", "RSET", "STARTTLS":
+	default:
+		if c.s.RequireTLS && !c.tls {
+			return c.reply(530, "5.7.0 Must issue a STARTTLS command first")
+		}
+	}
+
+	switch verb {
+	case "EHLO":
+		return c.ehlo(arg)
+	case "HELO":
+		if arg == "" {
+			return c.reply(501, "5.5.4 Syntax: HELO hostname")
+		}
+		c.helo = arg
+		c.reset()
+		return c.reply(250, c.s.domain())
+	case "STARTTLS":
+		return c.startTLS()
+	case "AUTH":
+		return c.auth(arg)
+	case "MAIL":
+		return c.mailFrom(arg)
+	case "RCPT":
+		return c.rcptTo(arg)
+	case "DATA":
+		return c.data()
+	case "RSET":
+		c.reset()
+		return c.reply(250, "2.0.0 Ok")
+	case "NOOP":
+		return c.reply(250, "2.0.0 Ok")
+	case "VRFY":
+		return c.reply(252, "2.0.0 Cannot VRFY user")
+	case "QUIT":
+		return c.reply(221, "2.0.0 Bye")
+	default:
+		return c.reply(500, "5.5.2 Command not recognized")
+	}
+}
+
+func (c *session) ehlo(arg string) error {
+	if arg == "" {
+		return c.reply(501, "5.5.4 Syntax: EHLO hostname")
+	}
+	c.helo = arg
+	c.reset()
+
+	lines := []string{c.s.domain()}
+	if c.s.Pipelining {
+		lines = append(lines, "PIPELINING")
+	}
+	if c.s.EightBitMIME {
+		lines = append(lines, "8BITMIME")
+	}
+	if c.s.Size > 0 {
+		lines = append(lines, "SIZE "+strconv.Itoa(c.s.Size))
+	}
+	if c.s.StartTLS && !c.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if len(c.s.Auth) > 0 {
+		lines = append(lines, "AUTH "+strings.Join(c.s.Auth, " "))
+	}
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if err := c.text.PrintfLine("250%s%s", sep, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *session) startTLS() error {
+	if !c.s.StartTLS {
+		return c.reply(502, "5.5.1 STARTTLS not supported")
+	}
+	if c.tls {
+		return c.reply(503, "5.5.1 TLS already active")
+	}
+	if err := c.reply(220, "2.0.0 Ready to start TLS"); err != nil {
+		return err
+	}
+
+	tc := tls.Server(c.conn, c.s.tlsConfig())
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.tls = tc, true
+	c.text = textproto.NewConn(tc)
+	// The client must say hello again, see RFC 3207 - 4.2.
+	c.helo, c.user = "", ""
+	c.reset()
+	return nil
+}
+
+// readResponse sends the challenge and reads the base64 response.
+func (c *session) readResponse(challenge string) ([]byte, bool, error) {
+	if err := c.reply(334, base64.StdEncoding.EncodeToString([]byte(challenge))); err != nil {
+		return nil, false, err
+	}
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return nil, false, err
+	}
+	if line == "*" {
+		return nil, false, nil
+	}
+	resp, err := base64.StdEncoding.DecodeString(line)
+	return resp, err == nil, nil
+}
+
+func (c *session) auth(arg string) error {
+	if len(c.s.Auth) == 0 {
+		return c.reply(502, "5.5.1 AUTH not supported")
+	}
+	if c.helo == "" || c.user != "" || c.mail {
+		return c.reply(503, "5.5.1 Bad sequence of commands")
+	}
+
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return c.reply(501, "5.5.4 Syntax: AUTH mechanism")
+	}
+	mech := strings.ToUpper(fields[0])
+	supported := false
+	for _, m := range c.s.Auth {
+		supported = supported || strings.EqualFold(m, mech)
+	}
+	if !supported {
+		return c.reply(504, "5.5.4 Unrecognized authentication type")
+	}
+
+	var (
+		initial []byte
+		ok      = true
+		err     error
+	)
+	if len(fields) > 1 && fields[1] != "=" {
+		if initial, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+			return c.reply(501, "5.5.2 Cannot decode response")
+		}
+	}
+
+	user, valid := "", false
+	switch mech {
+	case "PLAIN":
+		if initial == nil {
+			if initial, ok, err = c.readResponse(""); err != nil || !ok {
+				break
+			}
+		}
+		parts := strings.Split(string(initial), "\x00")
+		if len(parts) == 3 {
+			user, valid = parts[1], c.s.verify(parts[1], parts[2])
+		}
+	case "LOGIN":
+		if initial == nil {
+			if initial, ok, err = c.readResponse("Username:"); err != nil || !ok {
+				break
+			}
+		}
+		var pass []byte
+		if pass, ok, err = c.readResponse("Password:"); err != nil || !ok {
+			break
+		}
+		user, valid = string(initial), c.s.verify(string(initial), string(pass))
+	case "CRAM-MD5":
+		challenge := fmt.Sprintf("<%d@%s>", time.Now().UnixNano(), c.s.domain())
+		var resp []byte
+		if resp, ok, err = c.readResponse(challenge); err != nil || !ok {
+			break
+		}
+		if i := bytes.LastIndexByte(resp, ' '); i >= 0 {
+			user, valid = string(resp[:i]), c.s.verifyCRAMMD5(string(resp[:i]), challenge, string(resp[i+1:]))
+		}
+	default:
+		return c.reply(504, "5.5.4 Unrecognized authentication type")
+	}
+
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		return c.reply(501, "5.7.0 Authentication cancelled")
+	case !valid:
+		return c.reply(535, "5.7.8 Authentication credentials invalid")
+	}
+	c.user = user
+	return c.reply(235, "2.7.0 Authentication successful")
+}
+
+func (s *Server) verify(user, pass string) bool {
+	if s.Users == nil {
+		return true
+	}
+	want, ok := s.Users[user]
+	return ok && want == pass
+}
+
+func (s *Server) verifyCRAMMD5(user, challenge, digest string) bool {
+	if s.Users == nil {
+		return true
+	}
+	pass, ok := s.Users[user]
+	if !ok {
+		return false
+	}
+	h := hmac.New(md5.New, []byte(pass))
+	h.Write([]byte(challenge))
+	return hmac.Equal([]byte(hex.EncodeToString(h.Sum(nil))), []byte(digest))
+}
+
+// parsePath parses the path of MAIL or RCPT, e.g. "FROM:<a@example.com> SIZE=100",
+// and returns the address and the parameters.
+func parsePath(prefix, arg string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	i := strings.IndexByte(arg, '>')
+	if i < 0 {
+		return "", nil, false
+	}
+	return arg[1:i], strings.Fields(arg[i+1:]), true
+}
+
+func (c *session) mailFrom(arg string) error {
+	switch {
+	case c.helo == "":
+		return c.reply(503, "5.5.1 Error: send HELO/EHLO first")
+	case c.mail:
+		return c.reply(503, "5.5.1 Error: nested MAIL command")
+	case c.s.RequireAuth && c.user == "":
+		return c.reply(530, "5.7.0 Authentication required")
+	}
+
+	from, params, ok := parsePath("FROM:", arg)
+	if !ok {
+		return c.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+	}
+	for _, param := range params {
+		if !strings.HasPrefix(strings.ToUpper(param), "SIZE=") || c.s.Size <= 0 {
+			continue
+		}
+		if size, err := strconv.Atoi(param[5:]); err == nil && size > c.s.Size {
+			return c.reply(552, "5.3.4 Message size exceeds fixed limit")
+		}
+	}
+
+	c.mail, c.from = true, from
+	return c.reply(250, "2.1.0 Ok")
+}
+
+func (c *session) rcptTo(arg string) error {
+	if !c.mail {
+		return c.reply(503, "5.5.1 Error: need MAIL command")
+	}
+	to, _, ok := parsePath("TO:", arg)
+	if !ok || to == "" {
+		return c.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+	}
+	c.rcpt = append(c.rcpt, to)
+	return c.reply(250, "2.1.5 Ok")
+}
+
+func (c *session) data() error {
+	switch {
+	case !c.mail:
+		return c.reply(503, "5.5.1 Error: need MAIL command")
+	case len(c.rcpt) == 0:
+		return c.reply(554, "5.5.1 Error: no valid recipients")
+	}
+	if err := c.reply(354, "End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+
+	data, err := c.text.ReadDotBytes()
+	if err != nil {
+		return err
+	}
+	// ReadDotBytes converts CRLF to LF, restore the line endings as sent.
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+
+	m := &Message{
+		Helo: c.helo,
+		User: c.user,
+		TLS:  c.tls,
+		From: c.from,
+		To:   c.rcpt,
+		Data: data,
+	}
+	c.reset()
+
+	if injected, stop := c.inject(".", ""); injected {
+		if stop {
+			return errDisconnect
+		}
+		return nil
+	}
+	if c.s.Size > 0 && len(data) > c.s.Size {
+		return c.reply(552, "5.3.4 Message size exceeds fixed limit")
+	}
+	m.parse()
+	return c.reply(250, "2.0.0 Ok: queued as "+c.s.capture(m))
+}
+
+// errDisconnect closes the session after an injected failure.
+var errDisconnect = errors.New("mailxtest: disconnect")
+
+// newCertificate generates a self-signed certificate of the loopback addresses.
+func newCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,188 @@
+package mailxtest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/valord577/mailx"
+)
+
+func testMessage() *mailx.Message {
+	m := mailx.NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("bob@example.com", "cora@example.com")
+	m.SetSubject("Héllo, world")
+	m.SetPlainBody("This is a text/plain body.")
+	m.AddHtmlBody("<p>This is a text/html body.</p>")
+	m.Attach("attach.txt", func(w io.Writer) (int, error) {
+		return io.WriteString(w, "this is a txt attachment.")
+	})
+	return m
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	if err := s.Dialer().Send(context.Background(), testMessage()); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+
+	msgs := s.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("messages: %d, want 1", len(msgs))
+	}
+	m := msgs[0]
+	if m.From != "alex@example.com" || strings.Join(m.To, ",") != "bob@example.com,cora@example.com" {
+		t.Fatalf("envelope: %s %v", m.From, m.To)
+	}
+	if m.TLS || m.User != "" || m.Helo != "localhost" || m.QueueID == "" {
+		t.Fatalf("session: %+v", m)
+	}
+	if got := m.Subject(); got != "Héllo, world" {
+		t.Fatalf("subject: %q", got)
+	}
+
+	parts, err := m.Parts()
+	if err != nil {
+		t.Fatalf("parts: %s", err.Error())
+	}
+	if len(parts) != 3 {
+		t.Fatalf("parts: %d, want 3", len(parts))
+	}
+	if p, _ := m.Part("text/plain"); p == nil || string(p.Body) != "This is a text/plain body." {
+		t.Fatalf("text/plain: %+v", p)
+	}
+	if p, _ := m.Part("text/html"); p == nil || string(p.Body) != "<p>This is a text/html body.</p>" {
+		t.Fatalf("text/html: %+v", p)
+	}
+	if p := parts[2]; p.Filename() != "attach.txt" || string(p.Body) != "this is a txt attachment." {
+		t.Fatalf("attachment: %q %q", p.Filename(), p.Body)
+	}
+
+	s.Reset()
+	if len(s.Messages()) != 0 {
+		t.Fatal("messages are not reset")
+	}
+}
+
+func TestServerTLSAuth(t *testing.T) {
+	for _, ssl := range []bool{false, true} {
+		for _, mech := range []string{"PLAIN", "LOGIN", "CRAM-MD5"} {
+			s := NewUnstartedServer()
+			s.SSLOnConnect = ssl
+			s.StartTLS = !ssl
+			s.RequireTLS = !ssl
+			s.RequireAuth = true
+			s.Auth = []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+			s.Users = map[string]string{"alex": "secret"}
+			s.Start()
+
+			d := s.Dialer()
+			d.Username, d.Password, d.AuthMechanism = "alex", "secret", mech
+			if err := d.Send(context.Background(), testMessage()); err != nil {
+				t.Fatalf("send (ssl: %v, %s): %s", ssl, mech, err.Error())
+			}
+			if m := s.Messages()[0]; !m.TLS || m.User != "alex" {
+				t.Fatalf("session (ssl: %v, %s): %+v", ssl, mech, m)
+			}
+
+			d.Password = "wrong"
+			err := d.Send(context.Background(), testMessage())
+			var protoErr *textproto.Error
+			if !errors.As(err, &protoErr) || protoErr.Code != 535 {
+				t.Fatalf("wrong password (ssl: %v, %s): %v", ssl, mech, err)
+			}
+			s.Close()
+		}
+	}
+}
+
+func TestServerRequireTLS(t *testing.T) {
+	s := NewUnstartedServer()
+	s.StartTLS = true
+	s.RequireTLS = true
+	s.Start()
+	defer s.Close()
+
+	d := s.Dialer()
+	d.StartTLSPolicy = mailx.NoStartTLS
+	err := d.Send(context.Background(), testMessage())
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 530 {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func TestServerFail(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.Fail(Failure{Command: "RCPT", Arg: "<cora@", Code: 450, Msg: "4.2.1 Mailbox busy", Times: 1})
+	err := s.Dialer().Send(context.Background(), testMessage())
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 450 || !mailx.IsTemporary(err) {
+		t.Fatalf("send: %v", err)
+	}
+	if len(s.Messages()) != 0 {
+		t.Fatal("message captured after failed RCPT")
+	}
+
+	// The failure is injected only once.
+	if err = s.Dialer().Send(context.Background(), testMessage()); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+
+	s.Fail(Failure{Command: ".", Code: 554, Msg: "5.7.1 Rejected as spam"})
+	err = s.Dialer().Send(context.Background(), testMessage())
+	if !errors.As(err, &protoErr) || protoErr.Code != 554 || mailx.IsTemporary(err) {
+		t.Fatalf("send: %v", err)
+	}
+
+	s.Reset()
+	s.Fail(Failure{Command: "CONNECT", Code: 421, Msg: "4.3.2 Service not available", Disconnect: true})
+	if err = s.Dialer().Send(context.Background(), testMessage()); err == nil {
+		t.Fatal("send: want error")
+	}
+	if len(s.Messages()) != 0 {
+		t.Fatalf("messages: %d, want 0", len(s.Messages()))
+	}
+}
+
+func TestServerSize(t *testing.T) {
+	s := NewUnstartedServer()
+	s.Size = 256
+	s.Start()
+	defer s.Close()
+
+	err := s.Dialer().Send(context.Background(), testMessage())
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 552 {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func TestServerReceipt(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	sender, err := s.Dialer().Dial()
+	if err != nil {
+		t.Fatalf("dial: %s", err.Error())
+	}
+	defer sender.Close()
+
+	for i := 0; i < 2; i++ {
+		r, err := sender.SendWithReceipt(testMessage())
+		if err != nil {
+			t.Fatalf("send: %s", err.Error())
+		}
+		if msgs := s.Messages(); len(msgs) != i+1 || msgs[i].QueueID != r.QueueID {
+			t.Fatalf("queue ID: %q", r.QueueID)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package mailx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// @author valor.
+
+// mboxTimeFormat is the format of the time in the "From " line, see asctime(3).
+const mboxTimeFormat = "Mon Jan _2 15:04:05 2006"
+
+// MboxTransport appends each email to an mbox file,
+// e.g. to archive a copy of the emails sent, see TeeTransport.
+//
+// The mboxrd format is written: each message starts with a "From " line
+// of the envelope sender, its lines matching /^>*From / are quoted with
+// one more '>', and it ends with an empty line. The message is written
+// with the local LF line endings.
+//
+// The file is locked by flock(2) while appending, on the platforms
+// supporting it. It is not locked on the others.
+type MboxTransport struct {
+	// Path is the path of the mbox file. It is created if not exists.
+	Path string
+}
+
+// writeMbox writes the message in the mboxrd format.
+func writeMbox(w io.Writer, from string, created time.Time, data []byte) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("From " + from + " " + created.UTC().Format(mboxTimeFormat) + "\n")
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			bw.WriteByte('>')
+		}
+		bw.Write(line)
+		if line[len(line)-1] != '\n' {
+			bw.WriteByte('\n')
+		}
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// Send implements Transport.
+func (t *MboxTransport) Send(ctx context.Context, m *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	from, _ := m.sender()
+
+	buf := &bytes.Buffer{}
+	lw := &lfWriter{w: buf}
+	if _, err := m.WriteTo(lw); err != nil {
+		return err
+	}
+	if err := lw.Close(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(t.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	// Seek after locking, the file may be appended by others.
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if err = writeMbox(f, from, time.Now(), buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// Do not leave a partial message in the mbox.
+		f.Truncate(end)
+		return err
+	}
+	return nil
+}
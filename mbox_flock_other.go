@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package mailx
+
+import (
+	"os"
+)
+
+// @author valor.
+
+// lockFile does nothing, flock(2) is not supported on the platform.
+func lockFile(*os.File) error {
+	return nil
+}
+
+func unlockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,55 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteMbox(t *testing.T) {
+	created := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	data := "Subject: test\n\nFrom here\n>From there\nnot From\n>>From x\nno newline"
+
+	b := &bytes.Buffer{}
+	if err := writeMbox(b, "", created, []byte(data)); err != nil {
+		t.Fatalf("write: %s", err.Error())
+	}
+	want := "From MAILER-DAEMON Wed May  1 08:00:00 2024\n" +
+		"Subject: test\n\n>From here\n>>From there\nnot From\n>>>From x\nno newline\n\n"
+	if b.String() != want {
+		t.Fatalf("got:\n%q\nwant:\n%q", b.String(), want)
+	}
+}
+
+func TestMboxTransport(t *testing.T) {
+	tr := &MboxTransport{Path: filepath.Join(t.TempDir(), "sent.mbox")}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tr.Send(context.Background(), testTraceMessage()); err != nil {
+				t.Errorf("send: %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(tr.Path)
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+	s := string(data)
+	if n := strings.Count(s, "\nFrom alex@example.com "); n != 7 || !strings.HasPrefix(s, "From alex@example.com ") {
+		t.Fatalf("messages: %d, want 8:\n%s", n+1, s)
+	}
+	if strings.Contains(s, "\r\n") || !strings.HasSuffix(s, "\n\n") {
+		t.Fatalf("line endings:\n%q", s)
+	}
+}
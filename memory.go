@@ -0,0 +1,73 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// @author valor.
+
+// SentMessage is an email recorded by MemoryTransport.
+type SentMessage struct {
+	// From and Rcpt are the envelope sender and recipients.
+	From string
+	Rcpt []string
+	// Data is the message rendered by Message.WriteTo when it was sent.
+	Data []byte
+	// Message is the sent email. It may be modified after sending,
+	// unlike Data.
+	Message *Message
+	// Time is the time when the email was sent.
+	Time time.Time
+}
+
+// MemoryTransport records the emails in memory instead of sending them,
+// e.g. for local development and assertions in tests.
+type MemoryTransport struct {
+	mu   sync.Mutex
+	sent []*SentMessage
+}
+
+// Send implements Transport.
+func (t *MemoryTransport) Send(ctx context.Context, m *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	from, _ := m.sender()
+	rcpt, err := m.rcpt()
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err = m.WriteTo(buf); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.sent = append(t.sent, &SentMessage{
+		From:    from,
+		Rcpt:    rcpt,
+		Data:    buf.Bytes(),
+		Message: m,
+		Time:    time.Now(),
+	})
+	t.mu.Unlock()
+	return nil
+}
+
+// Messages returns the recorded emails in order.
+func (t *MemoryTransport) Messages() []*SentMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*SentMessage(nil), t.sent...)
+}
+
+// Reset removes the recorded emails.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	t.sent = nil
+	t.mu.Unlock()
+}
@@ -0,0 +1,41 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"testing"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	tr := &MemoryTransport{}
+	m := testTraceMessage()
+	m.SetRcptBcc(&mail.Address{Address: "bcc@example.com"})
+	if err := tr.Send(context.Background(), m); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+
+	sent := tr.Messages()
+	if len(sent) != 1 {
+		t.Fatalf("messages: %d, want 1", len(sent))
+	}
+	s := sent[0]
+	if s.From != "alex@example.com" || len(s.Rcpt) != 2 || s.Rcpt[1] != "bcc@example.com" || s.Message != m {
+		t.Fatalf("sent: %+v", s)
+	}
+	if !bytes.Contains(s.Data, []byte("SUBJECT: This is a subject of email.\r\n")) ||
+		bytes.Contains(s.Data, []byte("bcc@example.com")) {
+		t.Fatalf("data:\n%s", s.Data)
+	}
+
+	tr.Reset()
+	if len(tr.Messages()) != 0 {
+		t.Fatal("messages are not reset")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tr.Send(ctx, m); err != context.Canceled {
+		t.Fatalf("send: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package mailx
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"mime"
 	"net/mail"
 	"runtime"
+	"sort"
 	"time"
 )
 
@@ -36,6 +38,17 @@ type Message struct {
 	header *header
 	parts  []*part
 	files  []*file
+
+	dkim *DKIMSigner
+
+	smimeSigner     *SMIMESigner
+	smimeRecipients []*x509.Certificate
+
+	pgpSigner    PGPSigner
+	pgpEncrypter PGPEncrypter
+
+	// frozen is the message rendered by freeze, which is written as is.
+	frozen []byte
 }
 
 func (m *Message) sender() (string, error) {
@@ -99,6 +112,10 @@ type header struct {
 
 	ua string
 
+	// msgID is set by SetMessageID. If empty,
+	// a new one is generated for each writing of the message.
+	msgID string
+
 	extra map[string][]string
 }
 
@@ -120,6 +137,10 @@ func (h *header) mimeVersion() string {
 }
 
 func (h *header) messageId() (string, error) {
+	if h.msgID != "" {
+		return h.msgID, nil
+	}
+
 	var buf [32]byte
 	_, err := rand.Read(buf[:])
 	if err != nil {
@@ -230,8 +251,14 @@ func (h *header) writeTo(w io.Writer) (int, error) {
 
 	length = len(h.extra)
 	if length > 0 {
-		for k, vs := range h.extra {
-			for _, v := range vs {
+		// The keys are sorted, so that the message is written the same.
+		keys := make([]string, 0, length)
+		for k := range h.extra {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range h.extra[k] {
 				b.WriteString(k)
 				b.WriteString(": ")
 				b.WriteString(headerEncoder.Encode(charset, v))
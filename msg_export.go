@@ -1,9 +1,15 @@
 package mailx
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/mail"
 	"strings"
 )
@@ -157,6 +163,38 @@ func (m *Message) SetDate(datefmt string) {
 	m.header.datefmt = datefmt
 }
 
+// SetMessageID sets the header of email message: 'MESSAGE-ID',
+// e.g. "<unique-id@example.com>".
+func (m *Message) SetMessageID(id string) {
+	m.header.msgID = id
+}
+
+// MessageID returns the header of email message: 'MESSAGE-ID',
+// which is set by SetMessageID. If not set, it is empty, and
+// a new one is generated each time the message is written,
+// see Receipt.MessageID for the one which is sent.
+func (m *Message) MessageID() string {
+	return m.header.msgID
+}
+
+// withMessageID returns the message and its header 'MESSAGE-ID'.
+// If it is not set, a copy of the message with a new one is returned,
+// so that the one which is written is known.
+func (m *Message) withMessageID() (*Message, string, error) {
+	if m.header.msgID != "" {
+		return m, m.header.msgID, nil
+	}
+	mid, err := m.header.messageId()
+	if err != nil {
+		return nil, "", errors.New("failed to generate 'MESSAGE-ID': " + err.Error())
+	}
+	h := *m.header
+	h.msgID = mid
+	c := *m
+	c.header = &h
+	return &c, mid, nil
+}
+
 // SetUserAgent sets the header of email message: 'USER-AGENT'.
 func (m *Message) SetUserAgent(ua string) {
 	m.header.ua = ua
@@ -254,9 +292,279 @@ func (m *Message) Embed(cid string, copier CopyFunc) {
 	m.files = append(m.files, f)
 }
 
+// AttachMessage adds a email message as a attachment of email message,
+// e.g. to forward it. It is written as 'message/rfc822' with the
+// 'Content-Transfer-Encoding' 7bit or 8bit, instead of base64.
+// If the server doesn't support 8BITMIME, or the body is signed with
+// S/MIME or OpenPGP, a message in 8bit is written as 'application/octet-stream'
+// in base64 instead.
+// The message is read at once, the error of reading it or of a line
+// longer than 998 octets is returned by WriteTo.
+func (m *Message) AttachMessage(filename string, raw io.Reader) {
+	b, err := ioutil.ReadAll(raw)
+	if err == nil {
+		b, err = normalizeRaw(b)
+	}
+	m.files = append(m.files, newMessageFile(filename, b, err))
+}
+
+func newMessageFile(filename string, raw []byte, err error) *file {
+	encoding := "7bit"
+	for _, c := range raw {
+		if c >= 0x80 || c == 0 {
+			encoding = "8bit"
+			break
+		}
+	}
+	return &file{
+		filename:   filename,
+		attachment: true,
+		ctype:      "message/rfc822",
+		encoding:   encoding,
+		copier: func(w io.Writer) (int, error) {
+			if err != nil {
+				return 0, err
+			}
+			return w.Write(raw)
+		},
+	}
+}
+
+// SetDKIMSigner sets the signer of DKIM, which signs the message
+// and prepends the header 'DKIM-Signature' each time it is written.
+// If nil, the message is not signed.
+func (m *Message) SetDKIMSigner(s *DKIMSigner) {
+	m.dkim = s
+}
+
+// SetSMIMESigner sets the signer of S/MIME, which wraps the body of
+// email message in 'multipart/signed' with a detached signature.
+// If nil, the message is not signed.
+func (m *Message) SetSMIMESigner(s *SMIMESigner) {
+	m.smimeSigner = s
+}
+
+// SetSMIMERecipients sets the certificates of the recipients of S/MIME,
+// which the body of email message is encrypted for, as 'application/pkcs7-mime'.
+// The message is signed before encrypting it, if the signer is set.
+// The certificate of the sender should be included to read the sent message.
+// Only the RSA keys are supported. If empty, the message is not encrypted.
+func (m *Message) SetSMIMERecipients(certs ...*x509.Certificate) {
+	m.smimeRecipients = certs
+}
+
+// SetPGPSigner sets the signer of OpenPGP, which wraps the body of email message
+// in 'multipart/signed; protocol="application/pgp-signature"', see RFC 3156 - 5.
+// If nil, the message is not signed.
+func (m *Message) SetPGPSigner(s PGPSigner) {
+	m.pgpSigner = s
+}
+
+// SetPGPEncrypter sets the encrypter of OpenPGP, which wraps the body of email message
+// in 'multipart/encrypted; protocol="application/pgp-encrypted"', see RFC 3156 - 4.
+// The message is signed before encrypting it, if the signer is set.
+// If nil, the message is not encrypted.
+func (m *Message) SetPGPEncrypter(e PGPEncrypter) {
+	m.pgpEncrypter = e
+}
+
 // WriteTo implements io.WriterTo.
 // It dumps the whole message to SMTP server.
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	return m.write(context.Background(), w, false)
+}
+
+// write writes the message, the context is passed to the signer and
+// the encrypter of OpenPGP. If sevenBit, the files in 8bit are encoded
+// by base64, e.g. for the servers which don't support 8BITMIME.
+func (m *Message) write(ctx context.Context, w io.Writer, sevenBit bool) (int64, error) {
+	if m.frozen != nil {
+		n, err := w.Write(m.frozen)
+		return int64(n), err
+	}
+	if m.dkim == nil {
+		return m.writeTo(ctx, w, sevenBit)
+	}
+
+	// The message is rendered before signing it.
+	b := &bytes.Buffer{}
+	if _, err := m.writeTo(ctx, b, sevenBit); err != nil {
+		return 0, err
+	}
+	sig, err := m.dkim.Sign(b.Bytes())
+	if err != nil {
+		return 0, errors.New("failed to sign DKIM: " + err.Error())
+	}
+	n, err := io.WriteString(w, sig)
+	if err != nil {
+		return int64(n), err
+	}
+	s, err := b.WriteTo(w)
+	return int64(n) + s, err
+}
+
+// messageWriter writes the message for a single sending,
+// see Sender.send.
+type messageWriter struct {
+	m        *Message
+	ctx      context.Context
+	sevenBit bool
+}
+
+// WriteTo implements io.WriterTo.
+// The errors of rendering the message are *messageError,
+// which are told from the errors of writing to w.
+func (mw messageWriter) WriteTo(w io.Writer) (int64, error) {
+	ew := &errWriter{w: w}
+	n, err := mw.m.write(mw.ctx, ew, mw.sevenBit)
+	if err != nil && ew.err == nil {
+		err = &messageError{err: err}
+	}
+	return n, err
+}
+
+// errWriter records the error of writing.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	n, err := ew.w.Write(p)
+	if err != nil {
+		ew.err = err
+	}
+	return n, err
+}
+
+// freeze renders the message once, and returns a copy of it which writes
+// the same bytes each time, e.g. to send it via several relays, or to send
+// and archive it. Since the servers may not support 8BITMIME, the files
+// in 8bit are encoded by base64. If the message has no sender, from is used.
+// The errors of the message are returned as *messageError.
+func (m *Message) freeze(ctx context.Context, from string) (*Message, error) {
+	if m.frozen != nil {
+		return m, nil
+	}
+
+	h := *m.header
+	if (h.from == nil || h.from.Address == "") && from != "" {
+		h.from = &mail.Address{Address: from}
+	}
+	mid, err := h.messageId()
+	if err != nil {
+		return nil, &messageError{err: errors.New("failed to generate 'MESSAGE-ID': " + err.Error())}
+	}
+	h.msgID, h.datefmt = mid, h.date()
+	c := *m
+	c.header = &h
+
+	if _, err = c.sender(); err != nil {
+		return nil, &messageError{err: err}
+	}
+	if _, err = c.rcpt(); err != nil {
+		return nil, &messageError{err: err}
+	}
+	b := &bytes.Buffer{}
+	if _, err = c.write(ctx, b, true); err != nil {
+		return nil, &messageError{err: err}
+	}
+	c.frozen = b.Bytes()
+	return &c, nil
+}
+
+// entityWrapper wraps the rendered MIME entity of the body,
+// e.g. to sign or encrypt it.
+type entityWrapper func(entity []byte, w io.Writer) (int, error)
+
+// wrappers returns the wrappers of the MIME entity in order.
+// The entity is signed before encrypting it.
+func (m *Message) wrappers(ctx context.Context) ([]entityWrapper, error) {
+	smime := m.smimeSigner != nil || len(m.smimeRecipients) > 0
+	pgp := m.pgpSigner != nil || m.pgpEncrypter != nil
+	if smime && pgp {
+		return nil, errors.New("both S/MIME and OpenPGP are set")
+	}
+
+	wrappers := make([]entityWrapper, 0, 2)
+	if m.smimeSigner != nil {
+		wrappers = append(wrappers, func(entity []byte, w io.Writer) (int, error) {
+			return signSMIME(m.smimeSigner, entity, w)
+		})
+	}
+	if len(m.smimeRecipients) > 0 {
+		wrappers = append(wrappers, func(entity []byte, w io.Writer) (int, error) {
+			return encryptSMIMEEntity(m.smimeRecipients, entity, w)
+		})
+	}
+	if m.pgpSigner != nil {
+		wrappers = append(wrappers, func(entity []byte, w io.Writer) (int, error) {
+			return signPGP(ctx, m.pgpSigner, entity, w)
+		})
+	}
+	if m.pgpEncrypter != nil {
+		wrappers = append(wrappers, func(entity []byte, w io.Writer) (int, error) {
+			return encryptPGP(ctx, m.pgpEncrypter, entity, w)
+		})
+	}
+	return wrappers, nil
+}
+
+func (m *Message) writeTo(ctx context.Context, w io.Writer, sevenBit bool) (int64, error) {
+	wrappers, err := m.wrappers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(wrappers) == 0 {
+		n, err := m.header.writeTo(w)
+		if err != nil {
+			return 0, err
+		}
+		s, err := m.writeEntity(w, sevenBit)
+		if err != nil {
+			return 0, err
+		}
+		return int64(n + s), nil
+	}
+
+	// The MIME entity is rendered before signing or encrypting it.
+	entity := &bytes.Buffer{}
+	if _, err = m.writeEntity(entity, sevenBit); err != nil {
+		return 0, err
+	}
+	for _, wrap := range wrappers {
+		wrapped := &bytes.Buffer{}
+		if _, err = wrap(entity.Bytes(), wrapped); err != nil {
+			return 0, err
+		}
+		entity = wrapped
+	}
+
+	n, err := m.header.writeTo(w)
+	if err != nil {
+		return 0, err
+	}
+	s, err := entity.WriteTo(w)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n) + s, nil
+}
+
+// newBoundary returns a random boundary of multipart.
+func newBoundary() (string, error) {
+	var buf [30]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return "--GolangMailxBoundary" + hex.EncodeToString(buf[:]), nil
+}
+
+// writeEntity writes the MIME entity of the body, that is,
+// 'multipart/mixed' with the parts and the files. The parts and
+// the embedded files are written in 'multipart/related', if any.
+func (m *Message) writeEntity(w io.Writer, sevenBit bool) (int, error) {
 	var (
 		s int = 0
 		n int
@@ -264,22 +572,14 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 		err error
 	)
 
-	var buf [30]byte
-	_, err = rand.Read(buf[:])
+	boundary, err := newBoundary()
 	if err != nil {
 		return 0, err
 	}
-	boundary := "--GolangMailxBoundary" + hex.EncodeToString(buf[:])
 
 	partStart := "--" + boundary
 	partClose := "--" + boundary + "--"
 
-	n, err = m.header.writeTo(w)
-	if err != nil {
-		return 0, err
-	}
-	s += n
-
 	n, err = io.WriteString(w, "Content-Type: multipart/mixed;\r\n")
 	if err != nil {
 		return 0, err
@@ -298,7 +598,28 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 	}
 	s += n
 
-	if len(m.parts) > 0 {
+	// The signed entity must be in 7bit, see RFC 3156 - 3 and RFC 8551 - 3.1.2.
+	sevenBit = sevenBit || m.pgpSigner != nil || m.smimeSigner != nil
+
+	var attachments, embedded []*file
+	for _, file := range m.files {
+		if sevenBit {
+			file = file.sevenBit()
+		}
+		if file.attachment {
+			attachments = append(attachments, file)
+		} else {
+			embedded = append(embedded, file)
+		}
+	}
+
+	if len(embedded) > 0 {
+		n, err = m.writeRelated(partStart, embedded, w)
+		if err != nil {
+			return 0, err
+		}
+		s += n
+	} else if len(m.parts) > 0 {
 		for _, part := range m.parts {
 			n, err = writePart(partStart, part, w)
 			if err != nil {
@@ -308,8 +629,8 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 		}
 	}
 
-	if len(m.files) > 0 {
-		for _, file := range m.files {
+	if len(attachments) > 0 {
+		for _, file := range attachments {
 			n, err = writeFile(partStart, file, w)
 			if err != nil {
 				return 0, err
@@ -324,7 +645,72 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 	}
 	s += n
 
-	return int64(s), nil
+	return s, nil
+}
+
+// writeRelated writes the parts and the embedded files as a part of
+// 'multipart/related', see RFC 2387. The root is the first of them.
+func (m *Message) writeRelated(partStart string, embedded []*file, out io.Writer) (int, error) {
+	var (
+		s int = 0
+		n int
+
+		err error
+	)
+
+	boundary, err := newBoundary()
+	if err != nil {
+		return 0, err
+	}
+
+	root := embedded[0].contentType()
+	if len(m.parts) > 0 {
+		root = m.parts[0].ctype
+	}
+	if mediaType, _, err := mime.ParseMediaType(root); err == nil {
+		root = mediaType
+	}
+
+	n, err = io.WriteString(out, partStart+"\r\n")
+	if err != nil {
+		return 0, err
+	}
+	s += n
+
+	n, err = io.WriteString(out, "Content-Type: multipart/related;\r\n type=\""+root+"\";\r\n boundary="+boundary+"\r\n")
+	if err != nil {
+		return 0, err
+	}
+	s += n
+
+	n, err = io.WriteString(out, "\r\n")
+	if err != nil {
+		return 0, err
+	}
+	s += n
+
+	for _, part := range m.parts {
+		n, err = writePart("--"+boundary, part, out)
+		if err != nil {
+			return 0, err
+		}
+		s += n
+	}
+	for _, file := range embedded {
+		n, err = writeFile("--"+boundary, file, out)
+		if err != nil {
+			return 0, err
+		}
+		s += n
+	}
+
+	n, err = io.WriteString(out, "--"+boundary+"--\r\n")
+	if err != nil {
+		return 0, err
+	}
+	s += n
+
+	return s, nil
 }
 
 func writePart(partStart string, part *part, out io.Writer) (int, error) {
@@ -411,7 +797,11 @@ func writeFile(partStart string, file *file, out io.Writer) (int, error) {
 		s += n
 	}
 
-	n, err = io.WriteString(out, "Content-Transfer-Encoding: "+multipartEncoding+"\r\n")
+	encoding := multipartEncoding
+	if file.encoding != "" {
+		encoding = file.encoding
+	}
+	n, err = io.WriteString(out, "Content-Transfer-Encoding: "+encoding+"\r\n")
 	if err != nil {
 		return 0, err
 	}
@@ -424,13 +814,21 @@ func writeFile(partStart string, file *file, out io.Writer) (int, error) {
 	s += n
 
 	// Headers ended, write the body of file
-	partWriter := multipartWriter(out)
-	n, err = file.copier(partWriter)
-	if err != nil {
-		return 0, err
+	if file.encoding != "" {
+		n, err = file.copier(out)
+		if err != nil {
+			return 0, err
+		}
+		s += n
+	} else {
+		partWriter := multipartWriter(out)
+		n, err = file.copier(partWriter)
+		if err != nil {
+			return 0, err
+		}
+		partWriter.Close()
+		s += n
 	}
-	partWriter.Close()
-	s += n
 
 	n, err = io.WriteString(out, "\r\n")
 	if err != nil {
@@ -0,0 +1,265 @@
+package mailx
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// @author valor.
+
+// The headers which are written from the structure of the message.
+var structuralHeaders = []string{
+	"MIME-VERSION", "CONTENT-TYPE", "CONTENT-TRANSFER-ENCODING",
+	"CONTENT-DISPOSITION", "CONTENT-ID",
+}
+
+// The headers which are added in transit, or which sign the original
+// message. They would be stale or invalid when the message is sent again.
+var traceHeaders = []string{
+	"RECEIVED", "RECEIVED-SPF", "RETURN-PATH", "DELIVERED-TO", "X-ORIGINAL-TO",
+	"AUTHENTICATION-RESULTS", "DKIM-SIGNATURE", "DOMAINKEY-SIGNATURE",
+}
+
+func isTraceHeader(k string) bool {
+	return containsString(traceHeaders, k) || strings.HasPrefix(k, "ARC-")
+}
+
+// ReadMessage parses an RFC 5322 message, e.g. a .eml file,
+// so that it can be modified and sent again.
+//
+// The multipart tree is flattened: the text parts become the parts
+// of the body, and the other parts become the attachments, or the
+// embedded files if they have a 'Content-ID'. The attached messages
+// ('message/rfc822') are kept as is, see AttachMessage. The transfer encodings
+// are decoded, and the text parts are converted to UTF-8 from the
+// charsets "utf-8", "us-ascii" and "iso-8859-1".
+//
+// The trace headers, e.g. 'Received', and the signatures, e.g.
+// 'DKIM-Signature', are dropped, since they would be stale or invalid.
+// The text parts in other charsets are kept as attachments with
+// their original bytes. The header 'Message-ID' is not kept, so that a new one is generated
+// when the message is sent again, see SetMessageID.
+func ReadMessage(r io.Reader) (*Message, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	return ReadMailMessage(msg)
+}
+
+// ReadMailMessage converts the parsed message to a Message, see ReadMessage.
+func ReadMailMessage(msg *mail.Message) (*Message, error) {
+	m := NewMessage()
+	if err := m.readHeader(msg.Header); err != nil {
+		return nil, err
+	}
+	if err := m.readPart(textproto.MIMEHeader(msg.Header), msg.Body, &mime.WordDecoder{}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Message) readHeader(h mail.Header) error {
+	dec := &mime.WordDecoder{}
+	parser := &mail.AddressParser{WordDecoder: dec}
+
+	addrs := func(key string) ([]*mail.Address, error) {
+		var list []*mail.Address
+		for _, v := range h[key] {
+			if strings.TrimSpace(v) == "" {
+				continue
+			}
+			l, err := parser.ParseList(v)
+			if err != nil {
+				return nil, errors.New("invalid email header '" + strings.ToUpper(key) + "': " + err.Error())
+			}
+			if len(l) > 1 {
+				m.header.singleRecvAddr = true
+			}
+			list = append(list, l...)
+		}
+		return list, nil
+	}
+
+	var err error
+	if v := h.Get("From"); v != "" {
+		if m.header.from, err = parser.Parse(v); err != nil {
+			return errors.New("invalid email header 'FROM': " + err.Error())
+		}
+	}
+	if m.header.to, err = addrs("To"); err != nil {
+		return err
+	}
+	if m.header.cc, err = addrs("Cc"); err != nil {
+		return err
+	}
+	if m.header.bcc, err = addrs("Bcc"); err != nil {
+		return err
+	}
+
+	decode := func(v string) string {
+		if s, err := dec.DecodeHeader(v); err == nil {
+			return s
+		}
+		return v
+	}
+	m.header.subject = decode(h.Get("Subject"))
+	m.header.datefmt = h.Get("Date")
+	m.header.ua = decode(h.Get("User-Agent"))
+
+	skip := append(m.header.presets(), structuralHeaders...)
+	for k, vs := range h {
+		k = strings.ToUpper(k)
+		if containsString(skip, k) || isTraceHeader(k) {
+			continue
+		}
+		for _, v := range vs {
+			m.header.extra[k] = append(m.header.extra[k], decode(v))
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeBody decodes the transfer encoding of the body.
+func decodeBody(h textproto.MIMEHeader, body io.Reader) ([]byte, error) {
+	switch cte := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))); cte {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "", "7bit", "8bit", "binary":
+	default:
+		return nil, errors.New("unsupported 'Content-Transfer-Encoding': " + cte)
+	}
+	return ioutil.ReadAll(body)
+}
+
+// toUTF8 converts the text from the charset to UTF-8.
+func toUTF8(charset string, b []byte) (string, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		if !utf8.Valid(b) {
+			return "", errors.New("invalid text of charset: " + charset)
+		}
+		return string(b), nil
+	case "iso-8859-1", "latin1":
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return string(r), nil
+	}
+	return "", errors.New("unsupported charset: " + charset)
+}
+
+// readPart walks the multipart tree, and adds the leaf parts
+// to the body or the files of the message.
+func (m *Message) readPart(h textproto.MIMEHeader, body io.Reader, dec *mime.WordDecoder) error {
+	mediaType, params := "text/plain", map[string]string{}
+	if ct := h.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return errors.New("invalid 'Content-Type': " + err.Error())
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = m.readPart(p.Header, p, dec); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, err := decodeBody(h, body)
+	if err != nil {
+		return err
+	}
+
+	disp, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if name, err := dec.DecodeHeader(filename); err == nil {
+		filename = name
+	}
+	cid := strings.Trim(h.Get("Content-Id"), "<> ")
+
+	switch {
+	case mediaType == "message/rfc822":
+		if filename == "" {
+			filename = "attachment-" + strconv.Itoa(len(m.files)+1) + ".eml"
+		}
+		raw, err := normalizeRaw(b)
+		if err != nil {
+			return err
+		}
+		m.files = append(m.files, newMessageFile(filename, raw, nil))
+	case cid != "" && disp != "attachment":
+		m.files = append(m.files, &file{
+			filename: cid, ctype: mime.FormatMediaType(mediaType, params), copier: newBytesCopier(b),
+		})
+	case disp == "attachment" || filename != "" || !strings.HasPrefix(mediaType, "text/"):
+		if filename == "" {
+			filename = m.attachmentName(mediaType)
+		}
+		m.files = append(m.files, &file{
+			filename: filename, attachment: true, ctype: mime.FormatMediaType(mediaType, params), copier: newBytesCopier(b),
+		})
+	default:
+		text, err := toUTF8(params["charset"], b)
+		if err != nil {
+			// The part is kept as is, instead of failing the whole message.
+			ctype := mime.FormatMediaType(mediaType, map[string]string{"charset": params["charset"]})
+			m.files = append(m.files, &file{
+				filename: m.attachmentName(mediaType), attachment: true, ctype: ctype, copier: newBytesCopier(b),
+			})
+			break
+		}
+		m.parts = append(m.parts, &part{ctype: mediaType, copier: newTextCopier(text)})
+	}
+	return nil
+}
+
+// attachmentName returns a name of the attachment without filename.
+func (m *Message) attachmentName(mediaType string) string {
+	filename := "attachment-" + strconv.Itoa(len(m.files)+1)
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		filename += exts[0]
+	}
+	return filename
+}
+
+func newBytesCopier(b []byte) CopyFunc {
+	return func(w io.Writer) (int, error) {
+		return w.Write(b)
+	}
+}
@@ -0,0 +1,220 @@
+package mailx
+
+import (
+	"bytes"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDump dumps the structure and the content of the message to compare them.
+func testDump(t *testing.T, m *Message) string {
+	b := &strings.Builder{}
+	h := m.header
+	b.WriteString("from: " + h.from.String() + "\n")
+	for _, list := range [][]*mail.Address{h.to, h.cc, h.bcc} {
+		for _, addr := range list {
+			b.WriteString("rcpt: " + addr.String() + "\n")
+		}
+	}
+	b.WriteString("subject: " + h.subject + "\ndate: " + h.datefmt + "\nid: " + h.msgID + "\nua: " + h.ua + "\n")
+
+	for _, p := range m.parts {
+		buf := &bytes.Buffer{}
+		if _, err := p.copier(buf); err != nil {
+			t.Fatalf("copy part: %s", err.Error())
+		}
+		b.WriteString("part: " + p.ctype + ": " + buf.String() + "\n")
+	}
+	for _, f := range m.files {
+		buf := &bytes.Buffer{}
+		if _, err := f.copier(buf); err != nil {
+			t.Fatalf("copy file: %s", err.Error())
+		}
+		b.WriteString("file: " + f.contentType() + "; " + f.disposition() + ": " + buf.String() + "\n")
+	}
+	return b.String()
+}
+
+func TestReadMessage(t *testing.T) {
+	m := NewMessage()
+	m.SetSingleRecvAddr(true)
+	m.SetFrom(&mail.Address{Name: "Alex Müller", Address: "alex@example.com"})
+	m.SetRcptTo(&mail.Address{Name: "aaa", Address: "aaa@example.com"}, &mail.Address{Address: "bbb@example.com"})
+	m.SetCc("ccc@example.com")
+	m.SetSubject("Grüße, this is a subject of email.")
+	m.SetDate("Wed, 01 May 2024 08:00:00 +0000")
+	m.SetMessageID("<1@example.com>")
+	m.SetUserAgent("mailx-test")
+	m.AddHeader("X-Mailer-Tag", "weekly")
+	m.SetPlainBody("This is a text/plain body.\r\nÜberall.")
+	m.AddHtmlBody("<p>This is a text/html body.</p>")
+	m.Embed("logo.png", newTextCopier("\x89PNG"))
+	m.Attach("attach.txt", newTextCopier("this is a txt attachment."))
+
+	raw := &bytes.Buffer{}
+	if _, err := m.WriteTo(raw); err != nil {
+		t.Fatalf("write message: %s", err.Error())
+	}
+	read, err := ReadMessage(bytes.NewReader(raw.Bytes()))
+	if err != nil {
+		t.Fatalf("read message: %s", err.Error())
+	}
+	m.SetMessageID("")
+	if got, want := testDump(t, read), testDump(t, m); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if !read.header.singleRecvAddr || !reflect.DeepEqual(read.header.extra["X-MAILER-TAG"], []string{"weekly"}) {
+		t.Fatalf("header: %+v", read.header)
+	}
+
+	// Round-trip again.
+	raw.Reset()
+	if _, err = read.WriteTo(raw); err != nil {
+		t.Fatalf("write message: %s", err.Error())
+	}
+	again, err := ReadMessage(raw)
+	if err != nil {
+		t.Fatalf("read message: %s", err.Error())
+	}
+	if got, want := testDump(t, again), testDump(t, m); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestReadMessageMultipart(t *testing.T) {
+	raw := "From: =?iso-8859-1?q?J=F6rg?= <jorg@example.com>\r\n" +
+		"To: aaa@example.com, \"B, b\" <bbb@example.com>\r\n" +
+		"Subject: =?utf-8?b?SMOpbGxv?=\r\n" +
+		"Received: from mx.example.com\r\n" +
+		"Return-Path: <jorg@example.com>\r\n" +
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=mail; b=abc\r\n" +
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; d=example.com; s=arc; b=abc\r\n" +
+		"X-Tag-B: b\r\n" +
+		"X-Tag-A: a\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"preamble\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Gr=FC=DFe, a long line which is soft=\r\n" +
+		" broken.\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p>Hi</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"=?utf-8?q?r=C3=A9sum=C3=A9.pdf?=\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0x\r\n" +
+		"LjQ=\r\n" +
+		"--outer--\r\n"
+
+	m, err := ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("read message: %s", err.Error())
+	}
+	want := "from: =?utf-8?q?J=C3=B6rg?= <jorg@example.com>\n" +
+		"rcpt: <aaa@example.com>\n" +
+		"rcpt: \"B, b\" <bbb@example.com>\n" +
+		"subject: Héllo\ndate: \nid: \nua: \n" +
+		"part: text/plain: Grüße, a long line which is soft broken.\n" +
+		"part: text/html: <p>Hi</p>\n" +
+		"file: application/pdf; attachment; filename=\"résumé.pdf\": %PDF-1.4\n"
+	if got := testDump(t, m); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	// The trace headers and the signatures are dropped.
+	if !reflect.DeepEqual(m.header.extra, map[string][]string{"X-TAG-A": {"a"}, "X-TAG-B": {"b"}}) {
+		t.Fatalf("extra: %v", m.header.extra)
+	}
+	// The extra headers are written in order.
+	b := &strings.Builder{}
+	if _, err = m.WriteTo(b); err != nil {
+		t.Fatalf("write message: %s", err.Error())
+	}
+	if !strings.Contains(b.String(), "X-TAG-A: a\r\nX-TAG-B: b\r\n") {
+		t.Fatalf("message:\n%s", b.String())
+	}
+
+	// The types of the files and 'multipart/related' are kept.
+	m, err = ReadMessage(strings.NewReader("From: a@example.com\r\nSubject: x\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/related; type=\"text/html\"; boundary=\"inner\"\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<img src=\"cid:logo@x\">\r\n" +
+		"--inner\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: <logo@x>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw==\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf; name=\"report\"\r\n" +
+		"Content-Disposition: attachment\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0x\r\n" +
+		"--outer--\r\n"))
+	if err != nil {
+		t.Fatalf("read message: %s", err.Error())
+	}
+	want = "part: text/html: <img src=\"cid:logo@x\">\n" +
+		"file: image/png; inline; filename=\"logo@x\": \x89PNG\n" +
+		"file: application/pdf; name=report; attachment; filename=\"report\": %PDF-1\n"
+	if got := testDump(t, m); !strings.HasSuffix(got, want) {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	m.SetTo("aaa@example.com")
+	b.Reset()
+	if _, err = m.WriteTo(b); err != nil {
+		t.Fatalf("write message: %s", err.Error())
+	}
+	for _, s := range []string{
+		"Content-Type: multipart/related;\r\n type=\"text/html\";",
+		"Content-Type: image/png\r\nContent-Disposition: inline; filename=\"logo@x\"\r\nContent-ID: <logo@x>\r\n",
+		"Content-Type: application/pdf; name=report\r\nContent-Disposition: attachment; filename=\"report\"\r\n",
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Fatalf("missing %q in message:\n%s", s, b.String())
+		}
+	}
+	again, err := ReadMessage(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("read message: %s", err.Error())
+	}
+	if got := testDump(t, again); !strings.HasSuffix(got, want) {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The text part in an unsupported charset is kept as is.
+	m, err = ReadMessage(strings.NewReader("Subject: x\r\n" +
+		"Content-Type: text/plain; charset=koi8-r\r\n\r\n\xf0\xd2\xc9\xd7\xc5\xd4"))
+	if err != nil {
+		t.Fatalf("read message: %s", err.Error())
+	}
+	if len(m.parts) != 0 || len(m.files) != 1 || m.files[0].contentType() != "text/plain; charset=koi8-r" {
+		t.Fatalf("files: %d, parts: %d", len(m.files), len(m.parts))
+	}
+	buf := &bytes.Buffer{}
+	m.files[0].copier(buf)
+	if buf.String() != "\xf0\xd2\xc9\xd7\xc5\xd4" {
+		t.Fatalf("file: %q", buf.String())
+	}
+}
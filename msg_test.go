@@ -133,6 +133,54 @@ func TestMessage7(t *testing.T) {
 	}
 }
 
+func TestMessage8(t *testing.T) {
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaaaa@example.com")
+	m.SetSubject("This is a subject of email.")
+
+	// A new one is generated for each writing.
+	if mid := m.MessageID(); mid != "" {
+		t.Fatalf("invalid message id: %s", mid)
+	}
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		b := &strings.Builder{}
+		if _, err := m.WriteTo(b); err != nil {
+			t.Fatalf("write message, err: %s", err.Error())
+		}
+		ids[b.String()[:strings.Index(b.String(), "\r\n")]] = true
+	}
+	if len(ids) != 2 {
+		t.Fatalf("message id is reused: %v", ids)
+	}
+
+	// The receipt reports the one which is sent.
+	c, mid, err := m.withMessageID()
+	if err != nil || c == m || m.MessageID() != "" {
+		t.Fatalf("message id is not fixed for one sending: %v", err)
+	}
+	b := &strings.Builder{}
+	if _, err = c.WriteTo(b); err != nil {
+		t.Fatalf("write message, err: %s", err.Error())
+	}
+	if !strings.Contains(b.String(), "MESSAGE-ID: "+mid+"\r\n") {
+		t.Fatalf("message id is not fixed for one sending")
+	}
+
+	m.SetMessageID("<1234@example.com>")
+	if c, mid, _ = m.withMessageID(); c != m || mid != "<1234@example.com>" {
+		t.Fatalf("invalid message id: %s", mid)
+	}
+	b.Reset()
+	if _, err := m.WriteTo(b); err != nil {
+		t.Fatalf("write message, err: %s", err.Error())
+	}
+	if !strings.Contains(b.String(), "MESSAGE-ID: <1234@example.com>\r\n") {
+		t.Fatalf("invalid message id")
+	}
+}
+
 func TestErrMessage1(t *testing.T) {
 	m := NewMessage()
 	m.SetSender("alex@example.com")
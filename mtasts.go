@@ -0,0 +1,322 @@
+package mailx
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// @author valor.
+
+// TXTResolver looks up the TXT records.
+// It is implemented by *net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// STSMode is the mode of an MTA-STS policy.
+type STSMode string
+
+const (
+	// STSModeEnforce fails the delivery if the policy is not satisfied.
+	STSModeEnforce STSMode = "enforce"
+	// STSModeTesting only records the failures of the policy.
+	STSModeTesting STSMode = "testing"
+	// STSModeNone disables the policy.
+	STSModeNone STSMode = "none"
+)
+
+const (
+	// According to RFC 8461, 3.2. (page 9)
+	// The policy body size SHOULD NOT exceed 64 KiB.
+	maxSTSPolicySize = 64 * 1024
+	// The max_age is a maximum value of 31557600 seconds.
+	maxSTSPolicyAge = 31557600 * time.Second
+)
+
+// STSPolicy is an MTA-STS policy, see RFC 8461.
+type STSPolicy struct {
+	// ID is the id of the policy from the TXT record.
+	ID string
+	// Mode is the mode of the policy.
+	Mode STSMode
+	// MX is the patterns of the permitted mail exchangers,
+	// e.g. "mail.example.com" or "*.example.net".
+	MX []string
+	// MaxAge is the lifetime of the policy.
+	MaxAge time.Duration
+	// Expires is the time when the cached policy expires.
+	Expires time.Time
+}
+
+// Match reports whether the host of the mail exchanger is permitted by the policy.
+// A wildcard matches only the left-most label, see RFC 8461 - 4.1.
+func (p *STSPolicy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, mx := range p.MX {
+		mx = strings.ToLower(strings.TrimSuffix(mx, "."))
+		if strings.HasPrefix(mx, "*.") {
+			i := strings.IndexByte(host, '.')
+			if i > 0 && host[i+1:] == mx[2:] {
+				return true
+			}
+		} else if host == mx {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSTSPolicy parses the body of an MTA-STS policy.
+func ParseSTSPolicy(r io.Reader) (*STSPolicy, error) {
+	p := &STSPolicy{}
+	version, maxAge := "", ""
+
+	scanner := bufio.NewScanner(io.LimitReader(r, maxSTSPolicySize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, errors.New("invalid MTA-STS policy line: " + line)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = STSMode(value)
+		case "mx":
+			p.MX = append(p.MX, value)
+		case "max_age":
+			maxAge = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, errors.New("invalid MTA-STS policy version: " + version)
+	}
+	switch p.Mode {
+	case STSModeEnforce, STSModeTesting:
+		if len(p.MX) == 0 {
+			return nil, errors.New("empty MTA-STS policy mx")
+		}
+	case STSModeNone:
+	default:
+		return nil, errors.New("invalid MTA-STS policy mode: " + string(p.Mode))
+	}
+
+	age, err := strconv.ParseUint(maxAge, 10, 32)
+	if err != nil {
+		return nil, errors.New("invalid MTA-STS policy max_age: " + maxAge)
+	}
+	p.MaxAge = time.Duration(age) * time.Second
+	if p.MaxAge > maxSTSPolicyAge {
+		p.MaxAge = maxSTSPolicyAge
+	}
+	return p, nil
+}
+
+// MTASTS fetches and caches the MTA-STS policies of the domains.
+type MTASTS struct {
+	// HTTPClient fetches the policies.
+	// It should not follow redirects, see RFC 8461 - 3.3.
+	// If nil, a client with a timeout of 1 minute is used.
+	HTTPClient *http.Client
+	// Resolver looks up the TXT records of the policies.
+	// If nil, net.DefaultResolver is used.
+	Resolver TXTResolver
+
+	mu    sync.Mutex
+	cache map[string]*STSPolicy
+}
+
+var defaultSTSClient = &http.Client{
+	Timeout: time.Minute,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (s *MTASTS) httpClient() *http.Client {
+	if s.HTTPClient == nil {
+		return defaultSTSClient
+	}
+	return s.HTTPClient
+}
+
+func (s *MTASTS) resolver() TXTResolver {
+	if s.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return s.Resolver
+}
+
+// lookupID returns the id of the policy from the TXT record of the domain,
+// or an empty string if there is no valid record.
+func (s *MTASTS) lookupID(ctx context.Context, domain string) (string, error) {
+	txts, err := s.resolver().LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+
+	id := ""
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		if id != "" {
+			// Multiple records are treated as no record.
+			return "", nil
+		}
+		for _, field := range strings.Split(txt, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				id = field[3:]
+			}
+		}
+		if id == "" {
+			return "", nil
+		}
+	}
+	return id, nil
+}
+
+func (s *MTASTS) fetch(ctx context.Context, domain string) (*STSPolicy, error) {
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("failed to fetch MTA-STS policy: " + resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/plain" {
+		return nil, errors.New("invalid MTA-STS policy content type: " + mediaType)
+	}
+	return ParseSTSPolicy(resp.Body)
+}
+
+// Policy returns the MTA-STS policy of the domain,
+// or nil if the domain has no policy.
+// The policies are cached until they expire.
+func (s *MTASTS) Policy(ctx context.Context, domain string) (*STSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	s.mu.Lock()
+	cached := s.cache[domain]
+	s.mu.Unlock()
+	if cached != nil && time.Now().After(cached.Expires) {
+		cached = nil
+	}
+
+	id, err := s.lookupID(ctx, domain)
+	if err != nil || id == "" {
+		// Keep using the cached policy, so that an attacker
+		// can't downgrade it by blocking the DNS.
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	if cached != nil && cached.ID == id {
+		return cached, nil
+	}
+
+	p, err := s.fetch(ctx, domain)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	p.ID = id
+	p.Expires = time.Now().Add(p.MaxAge)
+
+	s.mu.Lock()
+	if s.cache == nil {
+		s.cache = make(map[string]*STSPolicy)
+	}
+	s.cache[domain] = p
+	s.mu.Unlock()
+	return p, nil
+}
+
+// verifyPKIX verifies the certificate chain of the server against
+// the roots and the host name, like the crypto/tls does.
+func verifyPKIX(cs tls.ConnectionState, roots *x509.CertPool, host string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no server certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// stsDialer applies the MTA-STS policy to the Dialer of the mail exchanger.
+// In testing mode, the failures are recorded by fail instead.
+// The returned function reports whether a TLS connection was established.
+func stsDialer(d *Dialer, p *STSPolicy, fail func(error)) (func() bool, error) {
+	enforce := p.Mode == STSModeEnforce
+	if !p.Match(d.Host) {
+		err := errors.New("mx host is not permitted by MTA-STS policy: " + d.Host)
+		if enforce {
+			return nil, err
+		}
+		fail(err)
+	}
+
+	established := false
+	conf := d.tlsConfig().Clone()
+	roots := conf.RootCAs
+	conf.InsecureSkipVerify = true
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		established = true
+		if err := verifyPKIX(cs, roots, d.Host); err != nil {
+			if enforce {
+				return err
+			}
+			fail(err)
+		}
+		return nil
+	}
+
+	d.TLSConfig = conf
+	if enforce {
+		d.StartTLSPolicy = MandatoryStartTLS
+	}
+	return func() bool { return established }, nil
+}
@@ -0,0 +1,236 @@
+package mailx
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSTSPolicy = "version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n"
+
+func TestParseSTSPolicy(t *testing.T) {
+	p, err := ParseSTSPolicy(strings.NewReader(testSTSPolicy))
+	if err != nil {
+		t.Fatalf("ParseSTSPolicy: %s", err.Error())
+	}
+	if p.Mode != STSModeEnforce || len(p.MX) != 2 || p.MaxAge != 24*time.Hour {
+		t.Fatalf("invalid policy: %+v", p)
+	}
+
+	match := map[string]bool{
+		"mail.example.com":    true,
+		"MAIL.example.com.":   true,
+		"mx1.example.net":     true,
+		"example.net":         false,
+		"a.mx1.example.net":   false,
+		"mail2.example.com":   false,
+		"mail.example.com.cn": false,
+	}
+	for host, want := range match {
+		if got := p.Match(host); got != want {
+			t.Fatalf("Match(%s): got %t, want %t", host, got, want)
+		}
+	}
+
+	invalid := []string{
+		"mode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmax_age: 86400\n",
+		"version: STSv1\nmode: always\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv1\nmode: testing\nmx: mail.example.com\n",
+		"version: STSv1\nmode testing\n",
+	}
+	for _, s := range invalid {
+		if _, err = ParseSTSPolicy(strings.NewReader(s)); err == nil {
+			t.Fatalf("ParseSTSPolicy(%q): expected error", s)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func stsHTTPClient(fetched *int, policy *string) *http.Client {
+	return &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			*fetched++
+			if req.URL.String() != "https://mta-sts.example.com/.well-known/mta-sts.txt" {
+				return nil, errors.New("unexpected url: " + req.URL.String())
+			}
+			if *policy == "" {
+				return nil, errors.New("connection refused")
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+				Body:       io.NopCloser(strings.NewReader(*policy)),
+			}, nil
+		}),
+	}
+}
+
+func TestMTASTSPolicy(t *testing.T) {
+	fetched := 0
+	policy := testSTSPolicy
+	resolver := &mockResolver{txt: map[string][]string{
+		"_mta-sts.example.com": {"v=STSv1; id=20240101"},
+	}}
+	sts := &MTASTS{HTTPClient: stsHTTPClient(&fetched, &policy), Resolver: resolver}
+
+	p, err := sts.Policy(context.Background(), "Example.com.")
+	if err != nil || p == nil {
+		t.Fatalf("Policy: %v", err)
+	}
+	if p.ID != "20240101" || fetched != 1 {
+		t.Fatalf("invalid policy: %+v, fetched %d", p, fetched)
+	}
+
+	// cached
+	if p, err = sts.Policy(context.Background(), "example.com"); err != nil || p.ID != "20240101" || fetched != 1 {
+		t.Fatalf("expected cached policy, fetched %d", fetched)
+	}
+
+	// the policy is updated
+	resolver.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=20240202"}
+	policy = strings.Replace(testSTSPolicy, "enforce", "testing", 1)
+	if p, err = sts.Policy(context.Background(), "example.com"); err != nil || p.Mode != STSModeTesting || fetched != 2 {
+		t.Fatalf("expected updated policy, fetched %d", fetched)
+	}
+
+	// the cached policy survives the failures of DNS and HTTPS
+	delete(resolver.txt, "_mta-sts.example.com")
+	if p, err = sts.Policy(context.Background(), "example.com"); err != nil || p == nil || p.ID != "20240202" {
+		t.Fatalf("expected cached policy, got %v", err)
+	}
+	resolver.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=20240303"}
+	policy = ""
+	if p, err = sts.Policy(context.Background(), "example.com"); err != nil || p == nil || p.ID != "20240202" {
+		t.Fatalf("expected cached policy, got %v", err)
+	}
+
+	// no policy
+	if p, err = sts.Policy(context.Background(), "example.org"); err != nil || p != nil {
+		t.Fatalf("expected no policy, got %+v, %v", p, err)
+	}
+	resolver.txt["_mta-sts.example.org"] = []string{"v=STSv1; id=1", "v=STSv1; id=2"}
+	if p, err = sts.Policy(context.Background(), "example.org"); err != nil || p != nil {
+		t.Fatalf("expected no policy, got %+v, %v", p, err)
+	}
+}
+
+func TestSTSDialer(t *testing.T) {
+	cert, pool := testCertificate(t, "mail.example.com", "mx.example.org")
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+
+	policy := &STSPolicy{Mode: STSModeEnforce, MX: []string{"*.example.com", "mx.example.org"}}
+	failures := []error{}
+	fail := func(err error) { failures = append(failures, err) }
+
+	d := &Dialer{Host: "mx.example.net", TLSConfig: &tls.Config{RootCAs: pool}}
+	if _, err := stsDialer(d, policy, fail); err == nil {
+		t.Fatalf("expected error for mx host not permitted")
+	}
+
+	d = &Dialer{Host: "mail.example.com", TLSConfig: &tls.Config{RootCAs: pool}}
+	established, err := stsDialer(d, policy, fail)
+	if err != nil {
+		t.Fatalf("stsDialer: %s", err.Error())
+	}
+	if d.StartTLSPolicy != MandatoryStartTLS {
+		t.Fatalf("expected mandatory STARTTLS")
+	}
+	if err = d.TLSConfig.VerifyConnection(cs); err != nil {
+		t.Fatalf("VerifyConnection: %s", err.Error())
+	}
+	if !established() {
+		t.Fatalf("expected TLS established")
+	}
+
+	d = &Dialer{Host: "www.example.com", TLSConfig: &tls.Config{RootCAs: pool}}
+	if _, err = stsDialer(d, policy, fail); err != nil {
+		t.Fatalf("stsDialer: %s", err.Error())
+	}
+	if err = d.TLSConfig.VerifyConnection(cs); err == nil {
+		t.Fatalf("expected certificate error")
+	}
+
+	policy.Mode = STSModeTesting
+	d = &Dialer{Host: "mx.example.net", TLSConfig: &tls.Config{RootCAs: pool}}
+	if _, err = stsDialer(d, policy, fail); err != nil {
+		t.Fatalf("stsDialer: %s", err.Error())
+	}
+	if err = d.TLSConfig.VerifyConnection(cs); err != nil {
+		t.Fatalf("VerifyConnection: %s", err.Error())
+	}
+	if d.StartTLSPolicy != OpportunisticStartTLS || len(failures) != 2 {
+		t.Fatalf("expected failures recorded, got %v", failures)
+	}
+}
+
+func TestMXTransportSTS(t *testing.T) {
+	fetched := 0
+	policy := testSTSPolicy
+	resolver := &mockResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx.example.org.", Pref: 10},
+				{Host: "mail.example.com.", Pref: 20},
+			},
+		},
+		txt: map[string][]string{
+			"_mta-sts.example.com": {"v=STSv1; id=1"},
+		},
+	}
+
+	dialed := []string{}
+	stubNewSmtpClient := newSmtpClient
+	defer func() { newSmtpClient = stubNewSmtpClient }()
+	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		dialed = append(dialed, host)
+		return &mockSmtpClient{map[string]string{}}, nil
+	}
+
+	tr := &MXTransport{
+		Resolver: resolver,
+		STS:      &MTASTS{HTTPClient: stsHTTPClient(&fetched, &policy), Resolver: resolver},
+		NetDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, nil
+		},
+	}
+
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com")
+	m.SetSubject("This is a subject of email.")
+
+	// enforce: mx.example.org is not permitted,
+	// and mail.example.com doesn't support STARTTLS.
+	results, err := tr.Deliver(context.Background(), m)
+	if err == nil || results[0].Policy == nil {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if len(dialed) != 1 || dialed[0] != "mail.example.com" {
+		t.Fatalf("invalid dialed hosts: %v", dialed)
+	}
+
+	// testing: delivered with failures recorded
+	dialed = dialed[:0]
+	policy = strings.Replace(testSTSPolicy, "enforce", "testing", 1)
+	resolver.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	results, err = tr.Deliver(context.Background(), m)
+	if err != nil {
+		t.Fatalf("deliver: %s", err.Error())
+	}
+	if results[0].Host != "mx.example.org" || len(results[0].STSFailures) != 2 {
+		t.Fatalf("invalid result: %+v", results[0])
+	}
+}
@@ -0,0 +1,250 @@
+package mailx
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// @author valor.
+
+// Strategy is the order in which the relays of a MultiDialer are tried.
+type Strategy int
+
+const (
+	// PriorityStrategy tries the relays in order,
+	// the later ones are the fallbacks of the former.
+	PriorityStrategy Strategy = iota
+	// RoundRobinStrategy starts from the next relay of each sending.
+	RoundRobinStrategy
+	// WeightedStrategy orders the relays randomly,
+	// in proportion to their weights.
+	WeightedStrategy
+)
+
+const (
+	defaultMaxFailures = 3
+	defaultCoolDown    = time.Minute
+)
+
+// Relay is an SMTP relay of a MultiDialer.
+type Relay struct {
+	// Dialer dials the relay.
+	Dialer *Dialer
+	// Weight is the weight of the relay for WeightedStrategy.
+	// If less than 1, 1 is used.
+	Weight int
+}
+
+// relayHealth is the health of a relay.
+type relayHealth struct {
+	failures  int
+	coolUntil time.Time
+}
+
+// MultiDialer sends emails via one of several SMTP relays.
+// If a relay fails temporarily, the message is retried on the next relay.
+//
+// A relay is marked unhealthy after consecutive temporary failures,
+// and is tried after the healthy ones until its cool-down ends.
+type MultiDialer struct {
+	// Relays is the SMTP relays.
+	Relays []Relay
+	// Strategy is the order in which the relays are tried.
+	Strategy Strategy
+	// MaxFailures is the number of consecutive failures
+	// before a relay is marked unhealthy. If 0, 3 is used.
+	MaxFailures int
+	// CoolDown is the duration for which an unhealthy relay
+	// is deprioritized. If 0, 1 minute is used.
+	CoolDown time.Duration
+
+	mu     sync.Mutex
+	next   int
+	rand   *rand.Rand
+	health []relayHealth
+}
+
+// RelayError reports the errors of the relays tried by a MultiDialer, in order.
+type RelayError struct {
+	// Relays is the addresses of the relays tried.
+	Relays []string
+	// Errs is the error of each relay.
+	Errs []error
+}
+
+// Error implements error.
+func (e *RelayError) Error() string {
+	b := &strings.Builder{}
+	b.WriteString("failed to send via relays:")
+	for i, err := range e.Errs {
+		b.WriteString(" " + e.Relays[i] + ": " + err.Error() + ";")
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+// Unwrap returns the error of the last relay tried.
+func (e *RelayError) Unwrap() error {
+	if len(e.Errs) == 0 {
+		return nil
+	}
+	return e.Errs[len(e.Errs)-1]
+}
+
+func (md *MultiDialer) maxFailures() int {
+	if md.MaxFailures <= 0 {
+		return defaultMaxFailures
+	}
+	return md.MaxFailures
+}
+
+func (md *MultiDialer) coolDown() time.Duration {
+	if md.CoolDown <= 0 {
+		return defaultCoolDown
+	}
+	return md.CoolDown
+}
+
+// order returns the indexes of the relays to try, the healthy ones first.
+func (md *MultiDialer) order() []int {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	n := len(md.Relays)
+	if len(md.health) != n {
+		md.health = make([]relayHealth, n)
+	}
+
+	order := make([]int, 0, n)
+	switch md.Strategy {
+	case RoundRobinStrategy:
+		if md.next >= n {
+			md.next = 0
+		}
+		for i := 0; i < n; i++ {
+			order = append(order, (md.next+i)%n)
+		}
+		md.next++
+	case WeightedStrategy:
+		if md.rand == nil {
+			md.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		weights, total := make([]int, n), 0
+		for i, r := range md.Relays {
+			weights[i] = r.Weight
+			if weights[i] < 1 {
+				weights[i] = 1
+			}
+			total += weights[i]
+		}
+		// Weighted random sampling without replacement.
+		for len(order) < n {
+			x := md.rand.Intn(total)
+			for i, w := range weights {
+				if x < w {
+					order = append(order, i)
+					total -= w
+					weights[i] = 0
+					break
+				}
+				x -= w
+			}
+		}
+	default:
+		for i := 0; i < n; i++ {
+			order = append(order, i)
+		}
+	}
+
+	now := time.Now()
+	healthy := make([]int, 0, n)
+	var unhealthy []int
+	for _, i := range order {
+		if now.Before(md.health[i].coolUntil) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// report updates the health of the relay by the result of sending.
+func (md *MultiDialer) report(i int, err error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if isRateLimited(err) || isMessageError(err) {
+		// The relay is not at fault.
+		return
+	}
+	h := &md.health[i]
+	if !IsTemporary(err) {
+		// The relay replied.
+		h.failures, h.coolUntil = 0, time.Time{}
+		return
+	}
+	h.failures++
+	if h.failures >= md.maxFailures() {
+		h.coolUntil = time.Now().Add(md.coolDown())
+	}
+}
+
+// Healthy reports whether each relay is healthy, in order.
+func (md *MultiDialer) Healthy() []bool {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	now := time.Now()
+	healthy := make([]bool, len(md.Relays))
+	for i := range healthy {
+		healthy[i] = i >= len(md.health) || !now.Before(md.health[i].coolUntil)
+	}
+	return healthy
+}
+
+// DialAndSend sends the given emails via one of the relays.
+func (md *MultiDialer) DialAndSend(m *Message) error {
+	return md.Send(context.Background(), m)
+}
+
+// Send implements Transport.
+// The message is retried on the next relay for temporary errors only,
+// see IsTemporary, but not for a *RateLimitError. The message is rendered
+// once and sent the same via each relay, with the username of the first
+// relay tried as its sender if it has none. A *RelayError is returned
+// if no relay sent the message.
+func (md *MultiDialer) Send(ctx context.Context, m *Message) error {
+	order := md.order()
+	if len(order) == 0 {
+		return errors.New("no relay to send email")
+	}
+	// The message is checked and rendered once before dialing,
+	// so that its errors are neither retried on each relay
+	// nor counted as failures of the relays.
+	m, err := m.freeze(ctx, md.Relays[order[0]].Dialer.Username)
+	if err != nil {
+		return err
+	}
+
+	e := &RelayError{}
+	for _, i := range order {
+		d := md.Relays[i].Dialer
+		err = d.Send(ctx, m)
+		md.report(i, err)
+		if err == nil {
+			return nil
+		}
+
+		_, addr := d.network()
+		e.Relays = append(e.Relays, addr)
+		e.Errs = append(e.Errs, err)
+		if !IsTemporary(err) || isRateLimited(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	return e
+}
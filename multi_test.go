@@ -0,0 +1,194 @@
+package mailx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"sync"
+	"testing"
+)
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("connection refused"), true},
+		{&textproto.Error{Code: 421, Msg: "4.3.2 Service not available"}, true},
+		{&textproto.Error{Code: 550, Msg: "5.7.1 Rejected"}, false},
+		{&RcptError{Rcpt: []RcptStatus{{"aaa@example.com", 452, "4.2.2 Mailbox full"}}}, false},
+		{context.Canceled, false},
+		{&RelayError{Relays: []string{"a:25"}, Errs: []error{&textproto.Error{Code: 451}}}, true},
+		{&CopyError{Errs: []error{errors.New("disk full")}}, false},
+		{&RateLimitError{Limit: "messages"}, true},
+		{&messageError{err: errors.New("empty email header: 'SUBJECT'")}, false},
+	}
+	for i, tt := range tests {
+		if got := IsTemporary(tt.err); got != tt.want {
+			t.Fatalf("#%d: IsTemporary(%v): got %t, want %t", i, tt.err, got, tt.want)
+		}
+	}
+}
+
+// testMultiDialer returns a MultiDialer of the relays,
+// which fail the MAIL command with the given errors.
+func testMultiDialer(t *testing.T, errs map[string]error, hosts ...string) (*MultiDialer, *[]string) {
+	mu := &sync.Mutex{}
+	rcpts := make(map[string][]string)
+	dialed := []string{}
+
+	stubNewSmtpClient := newSmtpClient
+	t.Cleanup(func() { newSmtpClient = stubNewSmtpClient })
+	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		dialed = append(dialed, host)
+		return &mockMXClient{
+			mockSmtpClient: mockSmtpClient{map[string]string{}},
+
+			host:  host,
+			err:   errs[host],
+			mu:    mu,
+			rcpts: rcpts,
+		}, nil
+	}
+
+	md := &MultiDialer{}
+	for _, host := range hosts {
+		md.Relays = append(md.Relays, Relay{Dialer: &Dialer{
+			Host: host,
+			Port: 587,
+			NetDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, nil
+			},
+		}})
+	}
+	return md, &dialed
+}
+
+func testMultiMessage() *Message {
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com")
+	m.SetSubject("This is a subject of email.")
+	return m
+}
+
+func TestMultiDialerFailover(t *testing.T) {
+	errs := map[string]error{
+		"relay1.example.com": &textproto.Error{Code: 421, Msg: "4.3.2 Service not available"},
+	}
+	md, dialed := testMultiDialer(t, errs, "relay1.example.com", "relay2.example.com", "relay3.example.com")
+	md.MaxFailures = 2
+
+	for i := 0; i < 2; i++ {
+		if err := md.DialAndSend(testMultiMessage()); err != nil {
+			t.Fatalf("send: %s", err.Error())
+		}
+	}
+	want := []string{"relay1.example.com", "relay2.example.com", "relay1.example.com", "relay2.example.com"}
+	if len(*dialed) != len(want) {
+		t.Fatalf("invalid dialed relays: %v", *dialed)
+	}
+	for i := range want {
+		if (*dialed)[i] != want[i] {
+			t.Fatalf("invalid dialed relays: %v", *dialed)
+		}
+	}
+
+	// relay1 is unhealthy after 2 failures.
+	if healthy := md.Healthy(); healthy[0] || !healthy[1] || !healthy[2] {
+		t.Fatalf("invalid health: %v", healthy)
+	}
+	*dialed = (*dialed)[:0]
+	if err := md.DialAndSend(testMultiMessage()); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+	if len(*dialed) != 1 || (*dialed)[0] != "relay2.example.com" {
+		t.Fatalf("invalid dialed relays: %v", *dialed)
+	}
+
+	// permanent errors are not retried.
+	errs["relay2.example.com"] = &textproto.Error{Code: 550, Msg: "5.7.1 Rejected"}
+	*dialed = (*dialed)[:0]
+	err := md.DialAndSend(testMultiMessage())
+	var relayErr *RelayError
+	if !errors.As(err, &relayErr) || len(relayErr.Errs) != 1 || relayErr.Relays[0] != "relay2.example.com:587" {
+		t.Fatalf("expected *RelayError, got %v", err)
+	}
+	if IsTemporary(err) || len(*dialed) != 1 {
+		t.Fatalf("expected permanent error, dialed %v", *dialed)
+	}
+
+	// all relays fail temporarily.
+	errs["relay2.example.com"] = errs["relay1.example.com"]
+	errs["relay3.example.com"] = errs["relay1.example.com"]
+	if err = md.DialAndSend(testMultiMessage()); !errors.As(err, &relayErr) || len(relayErr.Errs) != 3 {
+		t.Fatalf("expected *RelayError, got %v", err)
+	}
+}
+
+func TestMultiDialerStrategy(t *testing.T) {
+	md, dialed := testMultiDialer(t, nil, "relay1.example.com", "relay2.example.com")
+	md.Strategy = RoundRobinStrategy
+	for i := 0; i < 3; i++ {
+		if err := md.Send(context.Background(), testMultiMessage()); err != nil {
+			t.Fatalf("send: %s", err.Error())
+		}
+	}
+	if len(*dialed) != 3 || (*dialed)[0] != "relay1.example.com" || (*dialed)[1] != "relay2.example.com" || (*dialed)[2] != "relay1.example.com" {
+		t.Fatalf("invalid dialed relays: %v", *dialed)
+	}
+
+	*dialed = (*dialed)[:0]
+	md.Strategy = WeightedStrategy
+	md.Relays[0].Weight = 1
+	md.Relays[1].Weight = 99
+	for i := 0; i < 200; i++ {
+		if err := md.Send(context.Background(), testMultiMessage()); err != nil {
+			t.Fatalf("send: %s", err.Error())
+		}
+	}
+	n := 0
+	for _, host := range *dialed {
+		if host == "relay2.example.com" {
+			n++
+		}
+	}
+	if n < 170 {
+		t.Fatalf("invalid weighted distribution: %d/200", n)
+	}
+
+	if err := (&MultiDialer{}).DialAndSend(testMultiMessage()); err == nil {
+		t.Fatalf("expected error without relays")
+	}
+}
+
+func TestMultiDialerMessageError(t *testing.T) {
+	md, dialed := testMultiDialer(t, nil, "relay1.example.com", "relay2.example.com")
+	md.MaxFailures = 1
+
+	noSubject := testMultiMessage()
+	noSubject.SetSubject("")
+	unsigned := testMultiMessage()
+	unsigned.SetPGPSigner(testPGPError{})
+	for _, m := range []*Message{noSubject, unsigned} {
+		// The message fails before dialing, without failover.
+		err := md.Send(context.Background(), m)
+		if err == nil || IsTemporary(err) {
+			t.Fatalf("expected permanent error, got %v", err)
+		}
+		var relayErr *RelayError
+		if errors.As(err, &relayErr) || len(*dialed) != 0 {
+			t.Fatalf("expected no relay tried, got %v, dialed %v", err, *dialed)
+		}
+		if healthy := md.Healthy(); !healthy[0] || !healthy[1] {
+			t.Fatalf("invalid health: %v", healthy)
+		}
+	}
+
+	// The errors of rendering the message while sending are not temporary.
+	if err := md.Relays[0].Dialer.Send(context.Background(), unsigned); err == nil || IsTemporary(err) {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+}
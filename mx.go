@@ -0,0 +1,273 @@
+package mailx
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// @author valor.
+
+// Resolver looks up the DNS records of the mail exchangers.
+// It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// MXTransport delivers emails directly to the mail exchangers
+// of the recipients' domains, without a relay.
+type MXTransport struct {
+	// Resolver looks up the MX and A/AAAA records.
+	// If nil, net.DefaultResolver is used.
+	Resolver Resolver
+	// LocalName is the host name sent by EHLO.
+	// It should be the fully qualified domain name of this host.
+	LocalName string
+	// Port is the port of the mail exchangers.
+	// If 0, port 25 is used.
+	Port int
+	// Timeout is the timeout of dialing each mail exchanger.
+	Timeout time.Duration
+	// NetDialer dials the connection to the mail exchangers.
+	// If nil, a net.Dialer is used.
+	NetDialer DialContextFunc
+	// TLSConfig is the TLS configuration for the STARTTLS extension,
+	// its ServerName is set to the host of each mail exchanger.
+	// If nil, the certificates are not verified (opportunistic TLS, RFC 7435).
+	TLSConfig *tls.Config
+	// STS enforces the MTA-STS policies of the domains, see RFC 8461.
+	// If nil, the policies are ignored.
+	STS *MTASTS
+	// DANE looks up the TLSA records of the mail exchangers, see RFC 7672.
+	// If the records are authenticated by DNSSEC, STARTTLS is mandatory
+	// and the certificates are verified against them instead of the MTA-STS policy.
+	// If nil, DANE is not used.
+	DANE TLSAResolver
+}
+
+// MXResult is the result of delivering to the recipients of a domain.
+type MXResult struct {
+	// Domain is the domain of the recipients.
+	Domain string
+	// Rcpt is the addresses of the recipients.
+	Rcpt []string
+	// Host is the mail exchanger which accepted the message.
+	Host string
+	// Err is the error of the last mail exchanger tried,
+	// or nil if the message was delivered.
+	Err error
+	// Policy is the MTA-STS policy of the domain, if any.
+	Policy *STSPolicy
+	// STSFailures is the failures of the MTA-STS policy in testing mode,
+	// which didn't prevent the delivery.
+	STSFailures []error
+	// DANE reports whether the mail exchanger was authenticated by DANE.
+	DANE bool
+}
+
+func (r *MXResult) stsFail(err error) {
+	r.STSFailures = append(r.STSFailures, err)
+}
+
+// MXError reports the domains to which the message was not delivered.
+type MXError struct {
+	Results []*MXResult
+}
+
+// Error implements error.
+func (e *MXError) Error() string {
+	b := &strings.Builder{}
+	b.WriteString("failed to deliver to domains:")
+	for _, r := range e.Results {
+		b.WriteString(" " + r.Domain + ": " + r.Err.Error() + ";")
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+func (t *MXTransport) resolver() Resolver {
+	if t.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return t.Resolver
+}
+
+// groupByDomain groups the recipients by their domains, in order.
+func groupByDomain(rcpt []string) []*MXResult {
+	results := make([]*MXResult, 0, 1)
+	index := make(map[string]*MXResult)
+	for _, addr := range rcpt {
+		domain := ""
+		if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+			domain = strings.ToLower(addr[i+1:])
+		}
+		r, ok := index[domain]
+		if !ok {
+			r = &MXResult{Domain: domain}
+			index[domain] = r
+			results = append(results, r)
+		}
+		r.Rcpt = append(r.Rcpt, addr)
+	}
+	return results
+}
+
+// lookupMX returns the hosts of the mail exchangers of the domain
+// in preference order. If the domain has no MX records, the domain
+// itself is the implicit mail exchanger, see RFC 5321 - 5.1.
+func (t *MXTransport) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := t.resolver().LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		mxs = nil
+	}
+
+	if len(mxs) == 0 {
+		if _, err = t.resolver().LookupHost(ctx, domain); err != nil {
+			return nil, err
+		}
+		return []string{domain}, nil
+	}
+
+	// Null MX, see RFC 7505.
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, errors.New("domain does not accept email: " + domain)
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// dialer returns the Dialer of the mail exchanger.
+func (t *MXTransport) dialer(host string) *Dialer {
+	port := t.Port
+	if port == 0 {
+		port = 25
+	}
+
+	var conf *tls.Config
+	if t.TLSConfig == nil {
+		conf = &tls.Config{ServerName: host, InsecureSkipVerify: true}
+	} else {
+		conf = t.TLSConfig.Clone()
+		conf.ServerName = host
+	}
+
+	return &Dialer{
+		Host:      host,
+		Port:      port,
+		TLSConfig: conf,
+		Timeout:   t.Timeout,
+		NetDialer: t.NetDialer,
+		LocalName: t.LocalName,
+
+		StartTLSPolicy: OpportunisticStartTLS,
+	}
+}
+
+// isPermanent reports whether err is a permanent negative reply of the server.
+func isPermanent(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code/100 == 5
+}
+
+// deliver tries the mail exchangers of the domain in preference order,
+// until one accepts the message or rejects it permanently.
+func (t *MXTransport) deliver(ctx context.Context, from string, m *Message, r *MXResult) {
+	hosts, err := t.lookupMX(ctx, r.Domain)
+	if err != nil {
+		r.Err = err
+		return
+	}
+
+	if t.STS != nil {
+		// Without a valid policy, deliver as if MTA-STS is not used.
+		if p, _ := t.STS.Policy(ctx, r.Domain); p != nil && p.Mode != STSModeNone {
+			r.Policy = p
+		}
+	}
+
+	for _, host := range hosts {
+		d := t.dialer(host)
+
+		dane := false
+		if t.DANE != nil {
+			if dane, err = daneDialer(ctx, d, t.DANE, r.Domain); err != nil {
+				continue
+			}
+		}
+
+		var established func() bool
+		if r.Policy != nil && !dane {
+			if established, err = stsDialer(d, r.Policy, r.stsFail); err != nil {
+				continue
+			}
+		}
+
+		var s *Sender
+		if s, err = d.DialContext(ctx); err != nil {
+			continue
+		}
+		if established != nil && !established() {
+			r.stsFail(errors.New("STARTTLS is not supported by " + host))
+		}
+
+		_, err = s.send(ctx, from, r.Rcpt, m)
+		s.Close()
+		if err == nil {
+			r.Host, r.DANE, r.Err = host, dane, nil
+			return
+		}
+		if isPermanent(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	r.Err = err
+}
+
+// Deliver delivers the email to the mail exchangers of each recipients' domain,
+// and returns the results per domain. A *MXError is returned along with
+// the results if the message was not delivered to some domains.
+func (t *MXTransport) Deliver(ctx context.Context, m *Message) ([]*MXResult, error) {
+	from, err := m.sender()
+	if err != nil {
+		return nil, err
+	}
+	rcpt, err := m.rcpt()
+	if err != nil {
+		return nil, err
+	}
+
+	results := groupByDomain(rcpt)
+	var failed []*MXResult
+	for _, r := range results {
+		t.deliver(ctx, from, m, r)
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) > 0 {
+		return results, &MXError{Results: failed}
+	}
+	return results, nil
+}
+
+// Send implements Transport.
+func (t *MXTransport) Send(ctx context.Context, m *Message) error {
+	_, err := t.Deliver(ctx, m)
+	return err
+}
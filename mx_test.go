@@ -0,0 +1,176 @@
+package mailx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"sync"
+	"testing"
+)
+
+type mockResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	txt   map[string][]string
+}
+
+func (r *mockResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *mockResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *mockResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// mockMXClient is a mock SMTP client of a mail exchanger,
+// which fails the MAIL command with the given error.
+type mockMXClient struct {
+	mockSmtpClient
+	host string
+	err  error
+
+	mu    *sync.Mutex
+	rcpts map[string][]string
+}
+
+func (c *mockMXClient) Mail(from string) error {
+	return c.err
+}
+
+func (c *mockMXClient) Rcpt(to string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rcpts[c.host] = append(c.rcpts[c.host], to)
+	return nil
+}
+
+func TestMXTransport(t *testing.T) {
+	resolver := &mockResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx2.example.com.", Pref: 20},
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx3.example.com.", Pref: 30},
+			},
+			"example.org": {
+				{Host: "mx.example.org.", Pref: 10},
+			},
+			"example.net": {
+				{Host: ".", Pref: 0},
+			},
+		},
+		hosts: map[string][]string{
+			"example.edu": {"192.0.2.1"},
+		},
+	}
+
+	mu := &sync.Mutex{}
+	rcpts := make(map[string][]string)
+	dialed := []string{}
+	errs := map[string]error{
+		"mx2.example.com": &textproto.Error{Code: 421, Msg: "4.3.2 Service not available"},
+		"mx.example.org":  &textproto.Error{Code: 550, Msg: "5.7.1 Rejected"},
+	}
+
+	stubNewSmtpClient := newSmtpClient
+	defer func() { newSmtpClient = stubNewSmtpClient }()
+	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		dialed = append(dialed, host)
+		return &mockMXClient{
+			mockSmtpClient: mockSmtpClient{map[string]string{"STARTTLS": ""}},
+
+			host:  host,
+			err:   errs[host],
+			mu:    mu,
+			rcpts: rcpts,
+		}, nil
+	}
+
+	tr := &MXTransport{
+		Resolver:  resolver,
+		LocalName: "mail.example.com",
+		NetDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "mx1.example.com:25" {
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		},
+	}
+
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com", "bbb@EXAMPLE.com", "ccc@example.org")
+	m.SetCc("ddd@example.net", "eee@example.edu")
+	m.SetSubject("This is a subject of email.")
+
+	results, err := tr.Deliver(context.Background(), m)
+	var mxErr *MXError
+	if !errors.As(err, &mxErr) || len(mxErr.Results) != 2 {
+		t.Fatalf("expected *MXError, got %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("invalid results: %d", len(results))
+	}
+
+	want := []struct {
+		domain string
+		host   string
+		rcpts  int
+		failed bool
+	}{
+		{"example.com", "mx3.example.com", 2, false},
+		{"example.org", "", 1, true},
+		{"example.net", "", 1, true},
+		{"example.edu", "example.edu", 1, false},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Domain != w.domain || r.Host != w.host || len(r.Rcpt) != w.rcpts || (r.Err != nil) != w.failed {
+			t.Fatalf("#%d: invalid result: %+v", i, r)
+		}
+	}
+
+	wantDialed := []string{"mx2.example.com", "mx3.example.com", "mx.example.org", "example.edu"}
+	if len(dialed) != len(wantDialed) {
+		t.Fatalf("invalid dialed hosts: %v", dialed)
+	}
+	for i := range dialed {
+		if dialed[i] != wantDialed[i] {
+			t.Fatalf("invalid dialed hosts: %v", dialed)
+		}
+	}
+	if len(rcpts["mx3.example.com"]) != 2 || len(rcpts["example.edu"]) != 1 {
+		t.Fatalf("invalid recipients: %v", rcpts)
+	}
+}
+
+func TestMXTransportErr(t *testing.T) {
+	tr := &MXTransport{Resolver: &mockResolver{}}
+
+	m := NewMessage()
+	m.SetTo("aaa@example.com")
+	if err := tr.Send(context.Background(), m); err == nil {
+		t.Fatalf("expected error without sender")
+	}
+
+	m.SetSender("alex@example.com")
+	err := tr.Send(context.Background(), m)
+	var mxErr *MXError
+	if !errors.As(err, &mxErr) || mxErr.Results[0].Domain != "example.com" {
+		t.Fatalf("expected *MXError, got %v", err)
+	}
+}
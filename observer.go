@@ -0,0 +1,185 @@
+package mailx
+
+import (
+	"errors"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// @author valor.
+
+// Observer observes the stages of sending emails, e.g. to export metrics.
+// Each method is called after its stage with the duration and the error
+// of the stage. The methods must be safe for concurrent use.
+// Embed NopObserver to implement only some of them.
+type Observer interface {
+	// OnDial is called after dialing the server.
+	// For SSLOnConnect, the duration includes the TLS handshake.
+	OnDial(network, addr string, duration time.Duration, err error)
+	// OnTLS is called after the STARTTLS command and the TLS handshake.
+	OnTLS(duration time.Duration, err error)
+	// OnAuth is called after the authentication with the SASL mechanism.
+	OnAuth(mechanism string, duration time.Duration, err error)
+	// OnMail is called after the MAIL command.
+	OnMail(from string, duration time.Duration, err error)
+	// OnRcpt is called after the RCPT command of each recipient.
+	OnRcpt(rcpt string, duration time.Duration, err error)
+	// OnData is called after the DATA command and the message of size bytes.
+	OnData(size int64, duration time.Duration, err error)
+	// OnSendDone is called after sending an email, with the receipt if sent.
+	// The connection is reused if an email was sent before on it.
+	OnSendDone(r *Receipt, reused bool, duration time.Duration, err error)
+}
+
+// NopObserver is an Observer which does nothing.
+type NopObserver struct{}
+
+// OnDial implements Observer.
+func (NopObserver) OnDial(string, string, time.Duration, error) {}
+
+// OnTLS implements Observer.
+func (NopObserver) OnTLS(time.Duration, error) {}
+
+// OnAuth implements Observer.
+func (NopObserver) OnAuth(string, time.Duration, error) {}
+
+// OnMail implements Observer.
+func (NopObserver) OnMail(string, time.Duration, error) {}
+
+// OnRcpt implements Observer.
+func (NopObserver) OnRcpt(string, time.Duration, error) {}
+
+// OnData implements Observer.
+func (NopObserver) OnData(int64, time.Duration, error) {}
+
+// OnSendDone implements Observer.
+func (NopObserver) OnSendDone(*Receipt, bool, time.Duration, error) {}
+
+// mechAuth records the mechanism started by the smtp.Auth.
+type mechAuth struct {
+	smtp.Auth
+	mech string
+}
+
+// Start implements smtp.Auth.
+func (a *mechAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	mech, resp, err := a.Auth.Start(server)
+	a.mech = mech
+	return mech, resp, err
+}
+
+// Span is a finished span of a stage of sending, in the style of OpenTelemetry.
+type Span struct {
+	// Name is the name of the stage: "smtp.dial", "smtp.starttls",
+	// "smtp.auth", "smtp.mail", "smtp.rcpt", "smtp.data" or "smtp.send".
+	Name string
+	// Start and End are the times when the stage started and ended.
+	Start time.Time
+	End   time.Time
+	// Attributes is the attributes of the span, e.g. "smtp.rcpt".
+	// The reply code of a failed stage is set as "smtp.reply_code".
+	Attributes map[string]string
+	// Err is the error of the stage, nil if succeeded.
+	Err error
+}
+
+// SpanExporter exports the finished spans.
+// It must be safe for concurrent use.
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+// SpanObserver is an Observer which exports a span for each stage.
+type SpanObserver struct {
+	Exporter SpanExporter
+}
+
+var _ Observer = (*SpanObserver)(nil)
+
+func (o *SpanObserver) export(name string, duration time.Duration, err error, attrs ...string) {
+	end := time.Now()
+	s := &Span{
+		Name:       name,
+		Start:      end.Add(-duration),
+		End:        end,
+		Attributes: make(map[string]string, len(attrs)/2+1),
+		Err:        err,
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.Attributes[attrs[i]] = attrs[i+1]
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		s.Attributes["smtp.reply_code"] = strconv.Itoa(protoErr.Code)
+	}
+	o.Exporter.ExportSpan(s)
+}
+
+// OnDial implements Observer.
+func (o *SpanObserver) OnDial(network, addr string, duration time.Duration, err error) {
+	o.export("smtp.dial", duration, err, "net.network", network, "net.addr", addr)
+}
+
+// OnTLS implements Observer.
+func (o *SpanObserver) OnTLS(duration time.Duration, err error) {
+	o.export("smtp.starttls", duration, err)
+}
+
+// OnAuth implements Observer.
+func (o *SpanObserver) OnAuth(mechanism string, duration time.Duration, err error) {
+	o.export("smtp.auth", duration, err, "smtp.auth.mechanism", mechanism)
+}
+
+// OnMail implements Observer.
+func (o *SpanObserver) OnMail(from string, duration time.Duration, err error) {
+	o.export("smtp.mail", duration, err, "smtp.from", from)
+}
+
+// OnRcpt implements Observer.
+func (o *SpanObserver) OnRcpt(rcpt string, duration time.Duration, err error) {
+	o.export("smtp.rcpt", duration, err, "smtp.rcpt", rcpt)
+}
+
+// OnData implements Observer.
+func (o *SpanObserver) OnData(size int64, duration time.Duration, err error) {
+	o.export("smtp.data", duration, err, "smtp.size", strconv.FormatInt(size, 10))
+}
+
+// OnSendDone implements Observer.
+func (o *SpanObserver) OnSendDone(r *Receipt, reused bool, duration time.Duration, err error) {
+	attrs := []string{"smtp.reused", strconv.FormatBool(reused)}
+	if r != nil {
+		attrs = append(attrs, "smtp.message_id", r.MessageID, "smtp.queue_id", r.QueueID)
+	}
+	o.export("smtp.send", duration, err, attrs...)
+}
+
+// InMemoryExporter keeps the exported spans in memory, e.g. for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// ExportSpan implements SpanExporter.
+func (e *InMemoryExporter) ExportSpan(s *Span) {
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	e.mu.Unlock()
+}
+
+// Spans returns the exported spans in order.
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Reset removes the exported spans.
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	e.spans = nil
+	e.mu.Unlock()
+}
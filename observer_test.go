@@ -0,0 +1,117 @@
+package mailx
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"testing"
+)
+
+func TestSpanObserver(t *testing.T) {
+	var done <-chan error
+	exp := &InMemoryExporter{}
+	d := &Dialer{
+		Host:     "localhost",
+		Port:     25,
+		Username: "user",
+		Password: "pass",
+
+		StartTLSPolicy: NoStartTLS,
+		Observer:       &SpanObserver{Exporter: exp},
+	}
+	d.NetDialer = scriptDialer(append([]string{
+		"S: 220 localhost ESMTP",
+		"C: EHLO localhost",
+		"S: 250-localhost",
+		"S: 250 AUTH PLAIN",
+	}, traceScript...), &done)
+
+	m := testTraceMessage()
+	m.SetMessageID("<1@example.com>")
+	if err := d.Send(context.Background(), m); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server: %s", err.Error())
+	}
+
+	want := []struct {
+		name       string
+		attr, want string
+	}{
+		{"smtp.dial", "net.addr", "localhost:25"},
+		{"smtp.auth", "smtp.auth.mechanism", "PLAIN"},
+		{"smtp.mail", "smtp.from", "alex@example.com"},
+		{"smtp.rcpt", "smtp.rcpt", "aaa@example.com"},
+		{"smtp.data", "smtp.size", ""},
+		{"smtp.send", "smtp.queue_id", "4F2A1"},
+	}
+	spans := exp.Spans()
+	if len(spans) != len(want) {
+		t.Fatalf("spans: %d, want %d", len(spans), len(want))
+	}
+	for i, w := range want {
+		s := spans[i]
+		if s.Name != w.name || s.Err != nil || s.End.Before(s.Start) {
+			t.Fatalf("span %d: %+v, want %s", i, s, w.name)
+		}
+		if got, ok := s.Attributes[w.attr]; !ok || (w.want != "" && got != w.want) {
+			t.Fatalf("span %s: %s = %q, want %q", s.Name, w.attr, got, w.want)
+		}
+	}
+	if spans[5].Attributes["smtp.message_id"] != "<1@example.com>" ||
+		spans[5].Attributes["smtp.reused"] != "false" {
+		t.Fatalf("send span: %v", spans[5].Attributes)
+	}
+
+	exp.Reset()
+	if len(exp.Spans()) != 0 {
+		t.Fatal("spans are not reset")
+	}
+}
+
+func TestSpanObserverRcptError(t *testing.T) {
+	var done <-chan error
+	exp := &InMemoryExporter{}
+	d := &Dialer{
+		Host: "localhost",
+		Port: 25,
+
+		StartTLSPolicy: NoStartTLS,
+		Observer:       &SpanObserver{Exporter: exp},
+	}
+	d.NetDialer = scriptDialer([]string{
+		"S: 220 localhost ESMTP",
+		"C: EHLO localhost",
+		"S: 250 localhost",
+		"C: MAIL FROM:<alex@example.com>",
+		"S: 250 2.1.0 Ok",
+		"C: RCPT TO:<aaa@example.com>",
+		"S: 550 5.1.1 User unknown",
+		"C: QUIT",
+		"S: 221 2.0.0 Bye",
+	}, &done)
+
+	err := d.Send(context.Background(), testTraceMessage())
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 550 {
+		t.Fatalf("send: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("server: %s", err.Error())
+	}
+
+	spans := exp.Spans()
+	names := make([]string, 0, len(spans))
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	if len(spans) != 4 || spans[2].Name != "smtp.rcpt" || spans[3].Name != "smtp.send" {
+		t.Fatalf("spans: %v", names)
+	}
+	for _, s := range spans[2:] {
+		if s.Err == nil || s.Attributes["smtp.reply_code"] != "550" {
+			t.Fatalf("span %s: %v %v", s.Name, s.Err, s.Attributes)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// @author valor.
+
+// PGPSigner signs the MIME entity of the body with OpenPGP.
+type PGPSigner interface {
+	// Sign returns the ASCII-armored detached signature of the data,
+	// and the lowercase name of its hash algorithm, e.g. "sha256",
+	// which is written as the parameter micalg "pgp-sha256".
+	// The data is signed exactly as it is given, which is already
+	// canonicalized with the CRLF line endings and in 7bit, see RFC 3156 - 5.
+	// The context is of sending, or context.Background() for Message.WriteTo.
+	Sign(ctx context.Context, data []byte) (signature []byte, hash string, err error)
+}
+
+// PGPEncrypter encrypts the MIME entity of the body with OpenPGP.
+type PGPEncrypter interface {
+	// Encrypt returns the ASCII-armored OpenPGP message of the data,
+	// which is encrypted for the recipients, see RFC 3156 - 4.
+	// The context is of sending, or context.Background() for Message.WriteTo.
+	Encrypt(ctx context.Context, data []byte) ([]byte, error)
+}
+
+// signPGP wraps the MIME entity in 'multipart/signed', see RFC 3156 - 5.
+// The entity is signed exactly as it is written.
+func signPGP(ctx context.Context, s PGPSigner, entity []byte, w io.Writer) (int, error) {
+	signature, hash, err := s.Sign(ctx, entity)
+	if err != nil {
+		return 0, errors.New("failed to sign OpenPGP: " + err.Error())
+	}
+	if hash == "" {
+		return 0, errors.New("failed to sign OpenPGP: empty hash algorithm")
+	}
+	// The armored signature may be ended with LF.
+	if signature, err = normalizeRaw(signature); err != nil {
+		return 0, err
+	}
+
+	boundary, err := newBoundary()
+	if err != nil {
+		return 0, err
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteString("Content-Type: multipart/signed;\r\n")
+	b.WriteString(" protocol=\"application/pgp-signature\"; micalg=pgp-" + strings.ToLower(hash) + ";\r\n")
+	b.WriteString(" boundary=\"" + boundary + "\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("--" + boundary + "\r\n")
+	b.Write(entity)
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	b.WriteString("Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n")
+	b.WriteString("Content-Description: OpenPGP digital signature\r\n")
+	b.WriteString("Content-Disposition: attachment; filename=\"signature.asc\"\r\n")
+	b.WriteString("\r\n")
+	b.Write(signature)
+	b.WriteString("--" + boundary + "--\r\n")
+	return w.Write(b.Bytes())
+}
+
+// encryptPGP wraps the MIME entity in 'multipart/encrypted', see RFC 3156 - 4.
+func encryptPGP(ctx context.Context, e PGPEncrypter, entity []byte, w io.Writer) (int, error) {
+	encrypted, err := e.Encrypt(ctx, entity)
+	if err != nil {
+		return 0, errors.New("failed to encrypt OpenPGP: " + err.Error())
+	}
+	if encrypted, err = normalizeRaw(encrypted); err != nil {
+		return 0, err
+	}
+
+	boundary, err := newBoundary()
+	if err != nil {
+		return 0, err
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteString("Content-Type: multipart/encrypted;\r\n")
+	b.WriteString(" protocol=\"application/pgp-encrypted\";\r\n")
+	b.WriteString(" boundary=\"" + boundary + "\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("--" + boundary + "\r\n")
+	b.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	b.WriteString("Content-Description: PGP/MIME version identification\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("Version: 1\r\n")
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	b.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	b.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	b.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n")
+	b.WriteString("\r\n")
+	b.Write(encrypted)
+	b.WriteString("--" + boundary + "--\r\n")
+	return w.Write(b.Bytes())
+}
+
+// OpenPGP signs and encrypts with the keys in memory,
+// it implements PGPSigner and PGPEncrypter.
+//
+// The keys are read by e.g. openpgp.ReadArmoredKeyRing. The private key
+// of Signer must be decrypted by openpgp.Entity.DecryptPrivateKeys first.
+type OpenPGP struct {
+	// Signer is the key to sign with.
+	Signer *openpgp.Entity
+	// Recipients are the keys to encrypt for.
+	// The key of the sender should be included to read the sent message.
+	Recipients []*openpgp.Entity
+	// Config is the config of signing and encrypting.
+	// If nil, the defaults are used, which sign with SHA-256.
+	Config *packet.Config
+}
+
+// pgpHashNames are the names of the hash algorithms in micalg, see RFC 3156 - 5.
+var pgpHashNames = map[crypto.Hash]string{
+	crypto.SHA224:   "sha224",
+	crypto.SHA256:   "sha256",
+	crypto.SHA384:   "sha384",
+	crypto.SHA512:   "sha512",
+	crypto.SHA3_256: "sha3-256",
+	crypto.SHA3_512: "sha3-512",
+}
+
+// Sign implements PGPSigner.
+func (o *OpenPGP) Sign(ctx context.Context, data []byte) ([]byte, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if o.Signer == nil {
+		return nil, "", errors.New("empty signer of OpenPGP")
+	}
+	hash, ok := pgpHashNames[o.Config.Hash()]
+	if !ok {
+		return nil, "", errors.New("unsupported hash algorithm: " + o.Config.Hash().String())
+	}
+
+	b := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(b, o.Signer, bytes.NewReader(data), o.Config); err != nil {
+		return nil, "", err
+	}
+	return b.Bytes(), hash, nil
+}
+
+// Encrypt implements PGPEncrypter.
+func (o *OpenPGP) Encrypt(ctx context.Context, data []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(o.Recipients) == 0 {
+		return nil, errors.New("empty recipients of OpenPGP")
+	}
+
+	b := &bytes.Buffer{}
+	aw, err := armor.Encode(b, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openpgp.Encrypt(aw, o.Recipients, nil, nil, o.Config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	if err = aw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,292 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// @author valor.
+
+// testPGP signs the data with its hash, and "encrypts" it by base64,
+// to check the wrapping of OpenPGP/MIME.
+type testPGP struct {
+	signed []byte
+	ctx    context.Context
+}
+
+func (p *testPGP) Sign(ctx context.Context, data []byte) ([]byte, string, error) {
+	p.signed, p.ctx = append([]byte{}, data...), ctx
+	sum := sha256.Sum256(data)
+	return []byte("-----BEGIN PGP SIGNATURE-----\n\n" + hex.EncodeToString(sum[:]) + "\n-----END PGP SIGNATURE-----\n"), "SHA256", nil
+}
+
+func (p *testPGP) Encrypt(ctx context.Context, data []byte) ([]byte, error) {
+	b := &bytes.Buffer{}
+	b.WriteString("-----BEGIN PGP MESSAGE-----\n\n")
+	s := base64.StdEncoding.EncodeToString(data)
+	for len(s) > 64 {
+		b.WriteString(s[:64] + "\n")
+		s = s[64:]
+	}
+	b.WriteString(s + "\n-----END PGP MESSAGE-----\n")
+	return b.Bytes(), nil
+}
+
+// testPGPParts returns the Content-Type parameters, the raw body and the parts of the message.
+func testPGPParts(t *testing.T, raw []byte, mediaType string) (map[string]string, []byte, [][]byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("read message: %s", err.Error())
+	}
+	if msg.Header.Get("Subject") != "This is a subject of email." {
+		t.Fatalf("subject: %s", msg.Header.Get("Subject"))
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mt != mediaType {
+		t.Fatalf("content type: %s", msg.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatalf("read body: %s", err.Error())
+	}
+
+	parts := [][]byte{}
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(p)
+		parts = append(parts, []byte(p.Header.Get("Content-Type")+"\n"+string(b)))
+	}
+	return params, body, parts
+}
+
+// testPGPSigned returns the raw bytes of the first part of 'multipart/signed'.
+func testPGPSigned(body []byte, boundary string) []byte {
+	delimiter := "--" + boundary
+	first := strings.Split(string(body), "\r\n"+delimiter)[0]
+	return []byte(strings.TrimPrefix(first, delimiter+"\r\n"))
+}
+
+func TestPGPSign(t *testing.T) {
+	signer := &testPGP{}
+	m := testTraceMessage()
+	m.SetPGPSigner(signer)
+	b := &bytes.Buffer{}
+	if _, err := m.WriteTo(b); err != nil {
+		t.Fatalf("write message: %s", err.Error())
+	}
+
+	params, body, parts := testPGPParts(t, b.Bytes(), "multipart/signed")
+	if params["protocol"] != "application/pgp-signature" || params["micalg"] != "pgp-sha256" {
+		t.Fatalf("params: %v", params)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("parts: %d", len(parts))
+	}
+
+	// The signed part is exactly the one sent.
+	signed := testPGPSigned(body, params["boundary"])
+	if !bytes.Equal(signed, signer.signed) {
+		t.Fatalf("signed:\n%s\nsent:\n%s", signer.signed, signed)
+	}
+	if !bytes.HasPrefix(signed, []byte("Content-Type: multipart/mixed;\r\n")) ||
+		!bytes.HasSuffix(signed, []byte("--\r\n")) {
+		t.Fatalf("signed part:\n%s", signed)
+	}
+
+	sum := sha256.Sum256(signed)
+	signature := string(parts[1])
+	if !strings.HasPrefix(signature, "application/pgp-signature; name=\"signature.asc\"\n") ||
+		!strings.Contains(signature, "\r\n"+hex.EncodeToString(sum[:])+"\r\n") {
+		t.Fatalf("signature part:\n%s", signature)
+	}
+}
+
+func TestPGPSign7Bit(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "sending")
+
+	signer := &testPGP{}
+	m := testTraceMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com")
+	m.AttachMessage("report.eml", strings.NewReader(testForwarded+"Grüße\n"))
+	m.SetPGPSigner(signer)
+	c := &testDataClient{mockSmtpClient: mockSmtpClient{map[string]string{"8BITMIME": ""}}}
+	if _, err := (&Sender{smtpClient: c}).SendContext(ctx, m); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+
+	// The context of sending is passed to the signer.
+	if signer.ctx.Value(ctxKey{}) != "sending" {
+		t.Fatalf("context: %v", signer.ctx)
+	}
+	// The signed entity is in 7bit, even if the server supports 8BITMIME.
+	for _, c := range signer.signed {
+		if c >= 0x80 {
+			t.Fatalf("signed entity in 8bit:\n%s", signer.signed)
+		}
+	}
+	if !bytes.Contains(signer.signed, []byte("Content-Type: application/octet-stream\r\n"+
+		"Content-Disposition: attachment; filename=\"report.eml\"\r\n"+
+		"Content-Transfer-Encoding: base64\r\n")) {
+		t.Fatalf("signed entity:\n%s", signer.signed)
+	}
+}
+
+func TestPGPEncrypt(t *testing.T) {
+	for _, sign := range []bool{false, true} {
+		m := testTraceMessage()
+		if sign {
+			m.SetPGPSigner(&testPGP{})
+		}
+		m.SetPGPEncrypter(&testPGP{})
+		b := &bytes.Buffer{}
+		if _, err := m.WriteTo(b); err != nil {
+			t.Fatalf("write message: %s", err.Error())
+		}
+
+		params, _, parts := testPGPParts(t, b.Bytes(), "multipart/encrypted")
+		if params["protocol"] != "application/pgp-encrypted" || len(parts) != 2 {
+			t.Fatalf("params: %v, parts: %d", params, len(parts))
+		}
+		if string(parts[0]) != "application/pgp-encrypted\nVersion: 1\r\n" {
+			t.Fatalf("version part: %q", parts[0])
+		}
+
+		lines := strings.Split(string(parts[1]), "\r\n")
+		if lines[0] != "application/octet-stream; name=\"encrypted.asc\"\n-----BEGIN PGP MESSAGE-----" {
+			t.Fatalf("encrypted part:\n%s", parts[1])
+		}
+		entity, err := base64.StdEncoding.DecodeString(strings.Join(lines[2:len(lines)-2], ""))
+		if err != nil {
+			t.Fatalf("decode entity: %s", err.Error())
+		}
+		prefix := "Content-Type: multipart/mixed;\r\n"
+		if sign {
+			prefix = "Content-Type: multipart/signed;\r\n protocol=\"application/pgp-signature\""
+		}
+		if !bytes.HasPrefix(entity, []byte(prefix)) {
+			t.Fatalf("entity:\n%s", entity)
+		}
+	}
+
+	// S/MIME and OpenPGP are exclusive.
+	m := testTraceMessage()
+	m.SetPGPSigner(&testPGP{})
+	m.SetSMIMESigner(&SMIMESigner{})
+	if _, err := m.WriteTo(&bytes.Buffer{}); err == nil || err.Error() != "both S/MIME and OpenPGP are set" {
+		t.Fatalf("expected error of both S/MIME and OpenPGP, got %v", err)
+	}
+}
+
+type testPGPError struct{}
+
+func (testPGPError) Sign(context.Context, []byte) ([]byte, string, error) {
+	return nil, "", errors.New("no key")
+}
+
+func (testPGPError) Encrypt(context.Context, []byte) ([]byte, error) {
+	return nil, errors.New("no key")
+}
+
+func TestPGPError(t *testing.T) {
+	m := testTraceMessage()
+	m.SetPGPSigner(testPGPError{})
+	if _, err := m.WriteTo(&bytes.Buffer{}); err == nil || err.Error() != "failed to sign OpenPGP: no key" {
+		t.Fatalf("expected error of signing, got %v", err)
+	}
+	m = testTraceMessage()
+	m.SetPGPEncrypter(testPGPError{})
+	if _, err := m.WriteTo(&bytes.Buffer{}); err == nil || err.Error() != "failed to encrypt OpenPGP: no key" {
+		t.Fatalf("expected error of encrypting, got %v", err)
+	}
+}
+
+func TestOpenPGP(t *testing.T) {
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	alex, err := openpgp.NewEntity("Alex", "", "alex@example.com", config)
+	if err != nil {
+		t.Fatalf("generate key: %s", err.Error())
+	}
+	o := &OpenPGP{Signer: alex, Recipients: []*openpgp.Entity{alex}}
+
+	m := testTraceMessage()
+	m.SetPGPSigner(o)
+	m.SetPGPEncrypter(o)
+	b := &bytes.Buffer{}
+	if _, err = m.WriteTo(b); err != nil {
+		t.Fatalf("write message: %s", err.Error())
+	}
+
+	_, _, parts := testPGPParts(t, b.Bytes(), "multipart/encrypted")
+	block, err := armor.Decode(bytes.NewReader(parts[1][bytes.IndexByte(parts[1], '\n')+1:]))
+	if err != nil {
+		t.Fatalf("decode armor: %s", err.Error())
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{alex}, nil, nil)
+	if err != nil {
+		t.Fatalf("decrypt: %s", err.Error())
+	}
+	entity, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("decrypt: %s", err.Error())
+	}
+
+	params, body, parts := testPGPParts(t, append([]byte("SUBJECT: This is a subject of email.\r\n"), entity...), "multipart/signed")
+	if params["micalg"] != "pgp-sha256" || len(parts) != 2 {
+		t.Fatalf("params: %v, parts: %d", params, len(parts))
+	}
+	signed := testPGPSigned(body, params["boundary"])
+	signature := parts[1][bytes.IndexByte(parts[1], '\n')+1:]
+	keyring := openpgp.EntityList{alex}
+	if _, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(signature), nil); err != nil {
+		t.Fatalf("verify: %s", err.Error())
+	}
+
+	// Any modification of the signed part breaks the signature.
+	tampered := bytes.Replace(signed, []byte("VGhp"), []byte("VGhq"), 1)
+	if _, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(tampered), bytes.NewReader(signature), nil); err == nil {
+		t.Fatalf("tampered part is verified")
+	}
+
+	// The micalg follows the hash of the config.
+	o.Config = &packet.Config{DefaultHash: crypto.SHA512}
+	if _, hash, err := o.Sign(context.Background(), []byte("data")); err != nil || hash != "sha512" {
+		t.Fatalf("expected sha512, got %q, %v", hash, err)
+	}
+
+	// The context is canceled before signing and encrypting.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err = o.Sign(ctx, []byte("data")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	if _, err = o.Encrypt(ctx, []byte("data")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	if _, _, err = (&OpenPGP{}).Sign(context.Background(), []byte("data")); err == nil {
+		t.Fatal("sign without signer: want error")
+	}
+	if _, err = (&OpenPGP{}).Encrypt(context.Background(), []byte("data")); err == nil {
+		t.Fatal("encrypt without recipients: want error")
+	}
+}
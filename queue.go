@@ -0,0 +1,624 @@
+package mailx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// @author valor.
+
+const (
+	queueDirName = "queue"
+	deadDirName  = "dead"
+
+	queueMsgExt  = ".eml"
+	queueItemExt = ".json"
+
+	defaultQueueConcurrency = 1
+	defaultQueueInterval    = 30 * time.Second
+	defaultQueueMaxAttempts = 10
+)
+
+// QueueAttempt is an attempt to deliver a queued email.
+type QueueAttempt struct {
+	// Time is the time of the attempt.
+	Time time.Time `json:"time"`
+	// Err is the error of the attempt.
+	Err string `json:"error"`
+}
+
+// QueueItem is the envelope and the delivery state of a queued email.
+// The rendered message is stored beside it.
+type QueueItem struct {
+	// ID is the unique id of the item.
+	ID string `json:"id"`
+	// From is the address of the envelope sender.
+	From string `json:"from"`
+	// Rcpt is the addresses of the envelope recipients.
+	Rcpt []string `json:"rcpt"`
+	// Size is the size of the rendered message.
+	Size int64 `json:"size"`
+	// Created is the time when the email was queued.
+	Created time.Time `json:"created"`
+	// NextAttempt is the time of the next delivery attempt.
+	NextAttempt time.Time `json:"next_attempt"`
+	// Attempts is the history of the failed delivery attempts.
+	Attempts []QueueAttempt `json:"attempts,omitempty"`
+}
+
+// Queue is a persistent outbound queue of emails.
+//
+// The rendered messages and their envelopes are spooled in the directory,
+// so that they survive restarts and failures of sending. Temporarily failed
+// emails are retried later, and permanently failed ones are moved to the
+// dead-letter directory.
+//
+// The spool directory should be used by one Queue at a time.
+type Queue struct {
+	// Dir is the spool directory. The pending emails are stored
+	// in its subdirectory "queue", and the dead ones in "dead".
+	Dir string
+	// Dialer delivers the emails. Flush and Run fail without it,
+	// the emails may still be enqueued.
+	Dialer *Dialer
+	// Concurrency is the number of emails delivered at the same time.
+	// If 0, 1 is used.
+	Concurrency int
+	// Interval is the interval of polling the due emails.
+	// If 0, 30 seconds is used.
+	Interval time.Duration
+	// MaxAttempts is the number of attempts before an email is moved
+	// to the dead-letter directory. If 0, 10 is used.
+	MaxAttempts int
+	// Backoff returns the delay before the next attempt
+	// after the given number of failed attempts.
+	// If nil, the delay doubles from 1 minute, up to 4 hours.
+	Backoff func(attempts int) time.Duration
+	// OnError is called with the errors which are not of the delivery
+	// attempts, e.g. of updating the spool directory, or of an unreadable
+	// item, which is moved to the dead-letter directory. The id is empty
+	// if the error is not about an item. Run keeps running after them.
+	OnError func(id string, err error)
+
+	mu       sync.Mutex
+	inflight map[string]bool
+	wake     chan struct{}
+}
+
+func (q *Queue) concurrency() int {
+	if q.Concurrency <= 0 {
+		return defaultQueueConcurrency
+	}
+	return q.Concurrency
+}
+
+func (q *Queue) interval() time.Duration {
+	if q.Interval <= 0 {
+		return defaultQueueInterval
+	}
+	return q.Interval
+}
+
+func (q *Queue) maxAttempts() int {
+	if q.MaxAttempts <= 0 {
+		return defaultQueueMaxAttempts
+	}
+	return q.MaxAttempts
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	if q.Backoff != nil {
+		return q.Backoff(attempts)
+	}
+	delay := time.Minute
+	for i := 1; i < attempts && delay < 4*time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > 4*time.Hour {
+		delay = 4 * time.Hour
+	}
+	return delay
+}
+
+func (q *Queue) path(dir, id, ext string) string {
+	return filepath.Join(q.Dir, dir, id+ext)
+}
+
+func (q *Queue) init() error {
+	for _, dir := range []string{queueDirName, deadDirName} {
+		if err := os.MkdirAll(filepath.Join(q.Dir, dir), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) wakeCh() chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.wake == nil {
+		q.wake = make(chan struct{}, 1)
+	}
+	return q.wake
+}
+
+func newQueueID() (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// writeFileAtomic writes the file via a temporary file,
+// so that a partially written file is never seen.
+func writeFileAtomic(name string, fn func(io.Writer) error) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = fn(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (q *Queue) save(dir string, item *QueueItem) error {
+	return writeFileAtomic(q.path(dir, item.ID, queueItemExt), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(item)
+	})
+}
+
+// Enqueue renders the email and stores it in the queue.
+// If the email has no sender, the username of the Dialer is used, if any.
+//
+// The message is rendered 7bit-safe, since the server of the delivery
+// is unknown yet, and it is delivered as is.
+func (q *Queue) Enqueue(m *Message) (*QueueItem, error) {
+	from := ""
+	if q.Dialer != nil {
+		from = q.Dialer.Username
+	}
+	m, err := m.freeze(context.Background(), from)
+	if err != nil {
+		return nil, err
+	}
+	from, _ = m.sender()
+	rcpt, _ := m.rcpt()
+	if err = q.init(); err != nil {
+		return nil, err
+	}
+
+	id, err := newQueueID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	item := &QueueItem{ID: id, From: from, Rcpt: rcpt, Created: now, NextAttempt: now}
+
+	// The message is written first, the item marks it complete.
+	msgPath := q.path(queueDirName, id, queueMsgExt)
+	err = writeFileAtomic(msgPath, func(w io.Writer) error {
+		n, err := w.Write(m.frozen)
+		item.Size = int64(n)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = q.save(queueDirName, item); err != nil {
+		os.Remove(msgPath)
+		return nil, err
+	}
+
+	select {
+	case q.wakeCh() <- struct{}{}:
+	default:
+	}
+	return item, nil
+}
+
+// errQueueNoDialer is returned when the queue delivers without a Dialer.
+var errQueueNoDialer = errors.New("queue has no dialer to deliver")
+
+// invalidItemError is returned when the item can't be decoded.
+type invalidItemError struct {
+	id  string
+	err error
+}
+
+// Error implements error.
+func (e *invalidItemError) Error() string {
+	return "invalid queue item " + e.id + ": " + e.err.Error()
+}
+
+func (q *Queue) onError(id string, err error) {
+	if q.OnError != nil {
+		q.OnError(id, err)
+	}
+}
+
+// list returns the items in the directory, and the errors
+// of the unreadable items, which are skipped.
+func (q *Queue) list(dir string) ([]*QueueItem, []*invalidItemError, error) {
+	entries, err := os.ReadDir(filepath.Join(q.Dir, dir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	var invalids []*invalidItemError
+	items := make([]*QueueItem, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), queueItemExt) {
+			continue
+		}
+		item, err := q.load(dir, strings.TrimSuffix(e.Name(), queueItemExt))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Delivered or moved meanwhile.
+				continue
+			}
+			var invalid *invalidItemError
+			if errors.As(err, &invalid) {
+				invalids = append(invalids, invalid)
+				continue
+			}
+			return nil, nil, err
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Created.Before(items[j].Created)
+	})
+	return items, invalids, nil
+}
+
+func (q *Queue) load(dir, id string) (*QueueItem, error) {
+	b, err := os.ReadFile(q.path(dir, id, queueItemExt))
+	if err != nil {
+		return nil, err
+	}
+	item := &QueueItem{}
+	if err = json.Unmarshal(b, item); err != nil {
+		return nil, &invalidItemError{id: id, err: err}
+	}
+	return item, nil
+}
+
+// Items returns the pending emails in the queue, oldest first.
+// The unreadable items are skipped.
+func (q *Queue) Items() ([]*QueueItem, error) {
+	items, _, err := q.list(queueDirName)
+	return items, err
+}
+
+// Dead returns the permanently failed emails, oldest first.
+// The unreadable items are skipped.
+func (q *Queue) Dead() ([]*QueueItem, error) {
+	items, _, err := q.list(deadDirName)
+	return items, err
+}
+
+// pending returns the pending emails to deliver, and moves the
+// unreadable items to the dead-letter directory, so that one of
+// them doesn't stop the queue.
+func (q *Queue) pending() ([]*QueueItem, error) {
+	items, invalids, err := q.list(queueDirName)
+	for _, invalid := range invalids {
+		q.quarantine(invalid.id, invalid)
+	}
+	return items, err
+}
+
+// Message opens the rendered message of the pending or dead email.
+func (q *Queue) Message(id string) (io.ReadCloser, error) {
+	f, err := os.Open(q.path(queueDirName, id, queueMsgExt))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(q.path(deadDirName, id, queueMsgExt))
+	}
+	return f, err
+}
+
+// move moves the item and its message between the directories.
+//
+// The new item is written first, then the message is moved, and the old
+// item is removed last, so that the message always has an item beside it.
+// If the move is interrupted, the item in the other directory is stale,
+// and settle removes it.
+func (q *Queue) move(from, to string, item *QueueItem) error {
+	if err := q.save(to, item); err != nil {
+		return err
+	}
+	if err := os.Rename(q.path(from, item.ID, queueMsgExt), q.path(to, item.ID, queueMsgExt)); err != nil {
+		os.Remove(q.path(to, item.ID, queueItemExt))
+		return err
+	}
+	return os.Remove(q.path(from, item.ID, queueItemExt))
+}
+
+// settle removes the stale item left by an interrupted move of the claimed
+// item, which is the one without the message beside it. The message is never
+// removed, and the item without a message in either directory is kept.
+func (q *Queue) settle(id string) error {
+	for _, dir := range [][2]string{{queueDirName, deadDirName}, {deadDirName, queueDirName}} {
+		if _, err := os.Stat(q.path(dir[0], id, queueMsgExt)); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if _, err := os.Stat(q.path(dir[1], id, queueMsgExt)); err != nil {
+			continue
+		}
+		err := os.Remove(q.path(dir[0], id, queueItemExt))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantine moves the unreadable item and its message as is
+// to the dead-letter directory.
+func (q *Queue) quarantine(id string, cause error) {
+	if !q.claim(id) {
+		return
+	}
+	defer q.release(id)
+
+	q.onError(id, cause)
+	err := os.Rename(q.path(queueDirName, id, queueMsgExt), q.path(deadDirName, id, queueMsgExt))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		q.onError(id, err)
+		return
+	}
+	err = os.Rename(q.path(queueDirName, id, queueItemExt), q.path(deadDirName, id, queueItemExt))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		q.onError(id, err)
+	}
+}
+
+// remove removes the item and its message from the directory.
+func (q *Queue) remove(dir, id string) error {
+	// The item is removed first, so a message without item is never delivered.
+	if err := os.Remove(q.path(dir, id, queueItemExt)); err != nil {
+		return err
+	}
+	return os.Remove(q.path(dir, id, queueMsgExt))
+}
+
+// Remove removes the pending or dead email.
+func (q *Queue) Remove(id string) error {
+	if !q.claim(id) {
+		return errors.New("queue item is being delivered: " + id)
+	}
+	defer q.release(id)
+
+	err := q.remove(queueDirName, id)
+	if errors.Is(err, os.ErrNotExist) {
+		err = q.remove(deadDirName, id)
+	}
+	return err
+}
+
+// Requeue moves the dead email back to the queue,
+// to be delivered at the next poll.
+func (q *Queue) Requeue(id string) error {
+	if !q.claim(id) {
+		return errors.New("queue item is being delivered: " + id)
+	}
+	defer q.release(id)
+
+	item, err := q.load(deadDirName, id)
+	if err != nil {
+		return err
+	}
+	item.NextAttempt = time.Now()
+	if err = q.move(deadDirName, queueDirName, item); err != nil {
+		return err
+	}
+
+	select {
+	case q.wakeCh() <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// claim marks the item in flight, and reports whether it was not.
+func (q *Queue) claim(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inflight[id] {
+		return false
+	}
+	if q.inflight == nil {
+		q.inflight = make(map[string]bool)
+	}
+	q.inflight[id] = true
+	return true
+}
+
+func (q *Queue) release(id string) {
+	q.mu.Lock()
+	delete(q.inflight, id)
+	q.mu.Unlock()
+}
+
+// readerTo copies the reader to the writer.
+type readerTo struct {
+	r io.Reader
+}
+
+// WriteTo implements io.WriterTo.
+func (r readerTo) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, r.r)
+}
+
+// send delivers the rendered message of the item.
+func (q *Queue) send(ctx context.Context, item *QueueItem, r io.Reader) error {
+	s, err := q.Dialer.dialReserved(ctx, item.Rcpt)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	_, err = s.send(ctx, item.From, item.Rcpt, readerTo{r: r})
+	return err
+}
+
+// deliver delivers the item, and records the failed attempt.
+// The item must be claimed. It returns the errors of updating
+// the spool directory, not the ones of the attempt.
+func (q *Queue) deliver(ctx context.Context, id string) error {
+	if err := q.settle(id); err != nil {
+		return err
+	}
+	// The item is reloaded, since it may have been handled
+	// since it was listed.
+	item, err := q.load(queueDirName, id)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(q.path(queueDirName, id, queueMsgExt))
+	if err != nil {
+		return err
+	}
+	err = q.send(ctx, item, f)
+	f.Close()
+	if err == nil {
+		return q.remove(queueDirName, item.ID)
+	}
+	if ctx.Err() != nil {
+		// The attempt was interrupted, not failed.
+		return ctx.Err()
+	}
+
+	now := time.Now()
+	item.Attempts = append(item.Attempts, QueueAttempt{Time: now, Err: err.Error()})
+	if !IsTemporary(err) || len(item.Attempts) >= q.maxAttempts() {
+		return q.move(queueDirName, deadDirName, item)
+	}
+	item.NextAttempt = now.Add(q.backoff(len(item.Attempts)))
+	return q.save(queueDirName, item)
+}
+
+// process delivers the items concurrently, and waits for them.
+// It returns the first error of delivering, after reporting all of them.
+func (q *Queue) process(ctx context.Context, items []*QueueItem) error {
+	sem := make(chan struct{}, q.concurrency())
+	wg := &sync.WaitGroup{}
+
+	mu := &sync.Mutex{}
+	var first error
+
+	for _, item := range items {
+		if !q.claim(item.ID) {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			q.release(item.ID)
+			wg.Wait()
+			return first
+		}
+
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer q.release(id)
+			err := q.deliver(ctx, id)
+			if err == nil || errors.Is(err, ctx.Err()) {
+				return
+			}
+			q.onError(id, err)
+			mu.Lock()
+			if first == nil {
+				first = err
+			}
+			mu.Unlock()
+		}(item.ID)
+	}
+	wg.Wait()
+	return first
+}
+
+// Flush delivers all the pending emails now, regardless of their schedules,
+// and waits for them. The failed attempts are recorded in the items,
+// the error of updating the spool directory is returned.
+func (q *Queue) Flush(ctx context.Context) error {
+	if q.Dialer == nil {
+		return errQueueNoDialer
+	}
+	items, err := q.pending()
+	if err != nil {
+		return err
+	}
+	if err = q.process(ctx, items); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Run delivers the due emails in the background, until the context is done.
+// It returns the error of the context.
+func (q *Queue) Run(ctx context.Context) error {
+	if q.Dialer == nil {
+		return errQueueNoDialer
+	}
+	if err := q.init(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(q.interval())
+	defer ticker.Stop()
+
+	for {
+		// The queue keeps running, the errors are reported only.
+		items, err := q.pending()
+		if err != nil {
+			q.onError("", err)
+		}
+		now := time.Now()
+		due := items[:0]
+		for _, item := range items {
+			if !now.Before(item.NextAttempt) {
+				due = append(due, item)
+			}
+		}
+		q.process(ctx, due)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-q.wakeCh():
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockQueueClient is a mock SMTP client which records the delivered messages,
+// or fails the MAIL command with the error.
+type mockQueueClient struct {
+	mockSmtpClient
+	err error
+
+	mu        *sync.Mutex
+	delivered *[]string
+	buf       *bytes.Buffer
+}
+
+func (c *mockQueueClient) Mail(from string) error {
+	return c.err
+}
+
+func (c *mockQueueClient) Data() (io.WriteCloser, error) {
+	c.buf = &bytes.Buffer{}
+	return c, nil
+}
+
+func (c *mockQueueClient) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func (c *mockQueueClient) Close() error {
+	if c.buf != nil {
+		c.mu.Lock()
+		*c.delivered = append(*c.delivered, c.buf.String())
+		c.mu.Unlock()
+		c.buf = nil
+	}
+	return nil
+}
+
+func testQueue(t *testing.T, err *error) (*Queue, *[]string) {
+	mu := &sync.Mutex{}
+	delivered := []string{}
+
+	stubNewSmtpClient := newSmtpClient
+	t.Cleanup(func() { newSmtpClient = stubNewSmtpClient })
+	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return &mockQueueClient{
+			mockSmtpClient: mockSmtpClient{map[string]string{"AUTH": "PLAIN"}},
+
+			err:       *err,
+			mu:        mu,
+			delivered: &delivered,
+		}, nil
+	}
+
+	q := &Queue{
+		Dir: t.TempDir(),
+		Dialer: &Dialer{
+			Host:     "smtp.example.com",
+			Port:     587,
+			Username: "alex@example.com",
+			NetDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, nil
+			},
+		},
+		Concurrency: 2,
+		MaxAttempts: 2,
+	}
+	return q, &delivered
+}
+
+func testQueueMessage(to string) *Message {
+	m := NewMessage()
+	m.SetTo(to)
+	m.SetSubject("This is a subject of email.")
+	m.SetPlainBody("This is a text/plain body.")
+	return m
+}
+
+func TestQueue(t *testing.T) {
+	var sendErr error
+	q, _ := testQueue(t, &sendErr)
+
+	item, err := q.Enqueue(testQueueMessage("aaa@example.com"))
+	if err != nil {
+		t.Fatalf("enqueue: %s", err.Error())
+	}
+	if item.From != "alex@example.com" || len(item.Rcpt) != 1 || item.Size == 0 {
+		t.Fatalf("invalid item: %+v", item)
+	}
+
+	// temporary failure
+	sendErr = &textproto.Error{Code: 421, Msg: "4.3.2 Service not available"}
+	if err = q.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %s", err.Error())
+	}
+	items, err := q.Items()
+	if err != nil || len(items) != 1 {
+		t.Fatalf("expected 1 pending item, got %d, %v", len(items), err)
+	}
+	if len(items[0].Attempts) != 1 || !items[0].NextAttempt.After(time.Now()) {
+		t.Fatalf("invalid retry schedule: %+v", items[0])
+	}
+	if !strings.Contains(items[0].Attempts[0].Err, "Service not available") {
+		t.Fatalf("invalid attempt: %+v", items[0].Attempts[0])
+	}
+
+	// a new queue on the same directory delivers it
+	sendErr = nil
+	q2, delivered2 := testQueue(t, &sendErr)
+	q2.Dir = q.Dir
+	if err = q2.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %s", err.Error())
+	}
+	if len(*delivered2) != 1 || !strings.Contains((*delivered2)[0], "This is a subject of email.") {
+		t.Fatalf("invalid delivered messages: %v", *delivered2)
+	}
+	if items, _ = q.Items(); len(items) != 0 {
+		t.Fatalf("expected empty queue, got %d", len(items))
+	}
+}
+
+func TestQueue7Bit(t *testing.T) {
+	var sendErr error
+	q, delivered := testQueue(t, &sendErr)
+
+	// The 8bit message is spooled in base64, the server
+	// of the delivery may not support 8BITMIME.
+	m := testQueueMessage("aaa@example.com")
+	m.AttachMessage("report.eml", strings.NewReader("Subject: Grüße\r\n\r\nÜberall.\r\n"))
+	item, err := q.Enqueue(m)
+	if err != nil {
+		t.Fatalf("enqueue: %s", err.Error())
+	}
+	if m.MessageID() != "" {
+		t.Fatalf("the message is modified: %s", m.MessageID())
+	}
+	b, err := os.ReadFile(q.path(queueDirName, item.ID, queueMsgExt))
+	if err != nil {
+		t.Fatalf("read spool: %s", err.Error())
+	}
+	if int64(len(b)) != item.Size {
+		t.Fatalf("expected size %d, got %d", len(b), item.Size)
+	}
+	for _, c := range b {
+		if c >= 0x80 {
+			t.Fatalf("8bit message in spool:\n%s", b)
+		}
+	}
+
+	if err = q.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %s", err.Error())
+	}
+	if len(*delivered) != 1 || (*delivered)[0] != string(b) {
+		t.Fatalf("invalid delivered messages: %v", *delivered)
+	}
+}
+
+func TestQueueNoDialer(t *testing.T) {
+	q := &Queue{Dir: t.TempDir()}
+
+	if _, err := q.Enqueue(testQueueMessage("aaa@example.com")); err == nil || !isMessageError(err) {
+		t.Fatalf("expected error of no sender, got %v", err)
+	}
+	m := testQueueMessage("aaa@example.com")
+	m.SetSender("alex@example.com")
+	item, err := q.Enqueue(m)
+	if err != nil {
+		t.Fatalf("enqueue: %s", err.Error())
+	}
+	if item.From != "alex@example.com" {
+		t.Fatalf("invalid item: %+v", item)
+	}
+	if err = q.Flush(context.Background()); err != errQueueNoDialer {
+		t.Fatalf("expected error of no dialer, got %v", err)
+	}
+	if err = q.Run(context.Background()); err != errQueueNoDialer {
+		t.Fatalf("expected error of no dialer, got %v", err)
+	}
+	if items, _ := q.Items(); len(items) != 1 || len(items[0].Attempts) != 0 {
+		t.Fatalf("expected 1 pending item, got %+v", items)
+	}
+}
+
+func TestQueueDead(t *testing.T) {
+	sendErr := error(&textproto.Error{Code: 550, Msg: "5.7.1 Rejected"})
+	q, delivered := testQueue(t, &sendErr)
+
+	item, err := q.Enqueue(testQueueMessage("aaa@example.com"))
+	if err != nil {
+		t.Fatalf("enqueue: %s", err.Error())
+	}
+	q.Flush(context.Background())
+
+	dead, err := q.Dead()
+	if err != nil || len(dead) != 1 || dead[0].ID != item.ID || len(dead[0].Attempts) != 1 {
+		t.Fatalf("expected dead item, got %v", err)
+	}
+	rc, err := q.Message(item.ID)
+	if err != nil {
+		t.Fatalf("message: %s", err.Error())
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if !strings.Contains(string(b), "This is a subject of email.") {
+		t.Fatalf("invalid message: %s", b)
+	}
+
+	// requeued and delivered
+	sendErr = nil
+	if err = q.Requeue(item.ID); err != nil {
+		t.Fatalf("requeue: %s", err.Error())
+	}
+	if items, _ := q.Items(); len(items) != 1 {
+		t.Fatalf("expected requeued item")
+	}
+	q.Flush(context.Background())
+	if len(*delivered) != 1 {
+		t.Fatalf("expected delivered message")
+	}
+
+	// too many temporary failures
+	sendErr = errors.New("connection reset by peer")
+	item, _ = q.Enqueue(testQueueMessage("bbb@example.com"))
+	q.Flush(context.Background())
+	if items, _ := q.Items(); len(items) != 1 {
+		t.Fatalf("expected pending item")
+	}
+	q.Flush(context.Background())
+	if dead, _ = q.Dead(); len(dead) != 1 || len(dead[0].Attempts) != 2 {
+		t.Fatalf("expected dead item after max attempts")
+	}
+
+	if err = q.Remove(item.ID); err != nil {
+		t.Fatalf("remove: %s", err.Error())
+	}
+	if dead, _ = q.Dead(); len(dead) != 0 {
+		t.Fatalf("expected no dead item")
+	}
+	if err = q.Remove(item.ID); err == nil {
+		t.Fatalf("expected error for removed item")
+	}
+}
+
+func TestQueueRun(t *testing.T) {
+	var sendErr error
+	q, delivered := testQueue(t, &sendErr)
+	q.Interval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- q.Run(ctx) }()
+
+	for _, to := range []string{"aaa@example.com", "bbb@example.com", "ccc@example.com"} {
+		if _, err := q.Enqueue(testQueueMessage(to)); err != nil {
+			t.Fatalf("enqueue: %s", err.Error())
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		items, _ := q.Items()
+		if len(items) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for delivery")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	if len(*delivered) != 3 {
+		t.Fatalf("expected 3 delivered messages, got %d", len(*delivered))
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := &Queue{}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Hour}
+	for i, attempts := range []int{1, 2, 3, 20} {
+		if got := q.backoff(attempts); got != want[i] {
+			t.Fatalf("backoff(%d): got %s, want %s", attempts, got, want[i])
+		}
+	}
+}
+
+func TestQueueStale(t *testing.T) {
+	var sendErr error
+	q, delivered := testQueue(t, &sendErr)
+	errs := []error{}
+	q.OnError = func(id string, err error) { errs = append(errs, err) }
+
+	if _, err := q.Enqueue(testQueueMessage("aaa@example.com")); err != nil {
+		t.Fatalf("enqueue: %s", err.Error())
+	}
+	stale, _ := q.Items()
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %s", err.Error())
+	}
+
+	// The items listed before the delivery are skipped.
+	if err := q.process(context.Background(), stale); err != nil {
+		t.Fatalf("process: %s", err.Error())
+	}
+	if items, _ := q.Items(); len(items) != 0 {
+		t.Fatalf("expected empty queue, got %+v", items[0])
+	}
+	if len(*delivered) != 1 || len(errs) != 0 {
+		t.Fatalf("expected 1 delivered message, got %d, %v", len(*delivered), errs)
+	}
+
+	// The move interrupted before moving the message is rolled back.
+	item, _ := q.Enqueue(testQueueMessage("bbb@example.com"))
+	q.save(deadDirName, item)
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %s", err.Error())
+	}
+	if items, _ := q.Items(); len(items) != 0 || len(*delivered) != 2 {
+		t.Fatalf("expected empty queue, got %d", len(items))
+	}
+	if dead, _ := q.Dead(); len(dead) != 0 {
+		t.Fatalf("expected no dead item, got %+v", dead[0])
+	}
+
+	// The move interrupted after moving the message is completed.
+	item, _ = q.Enqueue(testQueueMessage("ccc@example.com"))
+	q.save(deadDirName, item)
+	os.Rename(q.path(queueDirName, item.ID, queueMsgExt), q.path(deadDirName, item.ID, queueMsgExt))
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %s", err.Error())
+	}
+	if items, _ := q.Items(); len(items) != 0 || len(*delivered) != 2 {
+		t.Fatalf("expected empty queue, got %d", len(items))
+	}
+	if dead, _ := q.Dead(); len(dead) != 1 || dead[0].ID != item.ID {
+		t.Fatalf("expected 1 dead item, got %d", len(dead))
+	}
+
+	// The item without a message is kept, and the error is reported.
+	item, _ = q.Enqueue(testQueueMessage("ddd@example.com"))
+	os.Remove(q.path(queueDirName, item.ID, queueMsgExt))
+	if err := q.Flush(context.Background()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected error of no message, got %v", err)
+	}
+	if items, _ := q.Items(); len(items) != 1 || len(errs) != 1 {
+		t.Fatalf("expected 1 pending item, got %d, %v", len(items), errs)
+	}
+
+	// The claimed item is not requeued.
+	q.claim(item.ID)
+	if err := q.Requeue(item.ID); err == nil || !strings.Contains(err.Error(), "being delivered") {
+		t.Fatalf("expected error of claimed item, got %v", err)
+	}
+	q.release(item.ID)
+}
+
+func TestQueueInvalid(t *testing.T) {
+	var sendErr error
+	q, delivered := testQueue(t, &sendErr)
+	mu := &sync.Mutex{}
+	errs := map[string]error{}
+	q.OnError = func(id string, err error) {
+		mu.Lock()
+		errs[id] = err
+		mu.Unlock()
+	}
+
+	if _, err := q.Enqueue(testQueueMessage("aaa@example.com")); err != nil {
+		t.Fatalf("enqueue: %s", err.Error())
+	}
+	os.WriteFile(q.path(queueDirName, "corrupt", queueMsgExt), []byte("SUBJECT: x\r\n\r\n"), 0600)
+	os.WriteFile(q.path(queueDirName, "corrupt", queueItemExt), []byte("{"), 0600)
+	if items, err := q.Items(); err != nil || len(items) != 1 {
+		t.Fatalf("expected 1 readable item, got %d, %v", len(items), err)
+	}
+
+	// The unreadable item is moved to the dead-letter directory,
+	// and the others are still delivered.
+	q.Interval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- q.Run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		items, _ := q.Items()
+		if len(items) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for delivery")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+
+	if len(*delivered) != 1 {
+		t.Fatalf("expected 1 delivered message, got %d", len(*delivered))
+	}
+	if err := errs["corrupt"]; err == nil || !strings.Contains(err.Error(), "invalid queue item corrupt") {
+		t.Fatalf("expected error of invalid item, got %v", err)
+	}
+	if _, err := os.Stat(q.path(deadDirName, "corrupt", queueItemExt)); err != nil {
+		t.Fatalf("expected quarantined item: %s", err.Error())
+	}
+	if rc, err := q.Message("corrupt"); err != nil {
+		t.Fatalf("expected quarantined message: %s", err.Error())
+	} else {
+		rc.Close()
+	}
+	if dead, err := q.Dead(); err != nil || len(dead) != 0 {
+		t.Fatalf("expected no readable dead item, got %d, %v", len(dead), err)
+	}
+}
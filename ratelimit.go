@@ -0,0 +1,243 @@
+package mailx
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// @author valor.
+
+// The buckets of the domains are pruned when there are more of them.
+const maxDomainBuckets = 1024
+
+// Limit is the rate of a token bucket: N tokens per Per,
+// with a burst of Burst tokens. The zero Limit is unlimited.
+type Limit struct {
+	// N is the number of tokens refilled per Per.
+	N int
+	// Per is the period of refilling. If 0, 1 second is used.
+	Per time.Duration
+	// Burst is the capacity of the bucket. If 0, N is used.
+	Burst int
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst <= 0 {
+		return float64(l.N)
+	}
+	return float64(l.Burst)
+}
+
+// rate returns the tokens refilled per second.
+func (l Limit) rate() float64 {
+	per := l.Per
+	if per <= 0 {
+		per = time.Second
+	}
+	return float64(l.N) / per.Seconds()
+}
+
+// bucket is a token bucket. The tokens can go negative,
+// so that a request larger than the burst is allowed once
+// the bucket is full, and the following ones wait for the debt.
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l Limit, now time.Time) *bucket {
+	if l.N <= 0 {
+		return nil
+	}
+	return &bucket{limit: l, tokens: l.burst(), last: now}
+}
+
+func (b *bucket) advance(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.limit.rate()
+		if burst := b.limit.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+}
+
+// delay returns the time to wait until n tokens can be taken.
+func (b *bucket) delay(n float64) time.Duration {
+	if burst := b.limit.burst(); n > burst {
+		n = burst
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.limit.rate() * float64(time.Second))
+}
+
+// RateLimitError is returned by RateLimiter
+// if a limit is exhausted and NoWait is set.
+type RateLimitError struct {
+	// Limit is the name of the exhausted limit, e.g. "messages",
+	// "recipients", "bytes" or "recipients of example.com".
+	Limit string
+	// RetryAfter is the time to wait for the limit.
+	RetryAfter time.Duration
+}
+
+// Error implements error.
+func (e *RateLimitError) Error() string {
+	return "rate limit of " + e.Limit + " exceeded, retry after " + e.RetryAfter.String()
+}
+
+// RateLimiter limits the rate of the outgoing emails with token buckets.
+// It can be shared by several Dialers, see Dialer.RateLimiter.
+//
+// The messages and the recipients are taken before sending.
+// The bytes are taken after sending, since the size of the message
+// is unknown before, and the next message waits for them.
+type RateLimiter struct {
+	// Messages limits the number of messages.
+	Messages Limit
+	// Recipients limits the number of recipients.
+	Recipients Limit
+	// Bytes limits the size of messages.
+	Bytes Limit
+	// DomainRecipients limits the number of recipients of each domain.
+	DomainRecipients Limit
+	// NoWait returns a *RateLimitError instead of waiting
+	// if a limit is exhausted.
+	NoWait bool
+
+	mu         sync.Mutex
+	init       bool
+	messages   *bucket
+	recipients *bucket
+	bytes      *bucket
+	domains    map[string]*bucket
+}
+
+// domainCounts counts the recipients by their domains.
+func domainCounts(rcpt []string) map[string]int {
+	counts := make(map[string]int)
+	for _, addr := range rcpt {
+		domain := ""
+		if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+			domain = strings.ToLower(addr[i+1:])
+		}
+		counts[domain]++
+	}
+	return counts
+}
+
+// reserve takes the tokens if all the limits allow them,
+// otherwise it returns the longest delay and the name of its limit.
+func (l *RateLimiter) reserve(rcpt []string) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if !l.init {
+		l.init = true
+		l.messages = newBucket(l.Messages, now)
+		l.recipients = newBucket(l.Recipients, now)
+		l.bytes = newBucket(l.Bytes, now)
+	}
+
+	type take struct {
+		b    *bucket
+		n    float64
+		name string
+	}
+	takes := []take{
+		{l.messages, 1, "messages"},
+		{l.recipients, float64(len(rcpt)), "recipients"},
+		// Wait for the debt of the previous messages.
+		{l.bytes, 0, "bytes"},
+	}
+	if l.DomainRecipients.N > 0 {
+		if l.domains == nil || len(l.domains) > maxDomainBuckets {
+			l.pruneDomains(now)
+		}
+		for domain, n := range domainCounts(rcpt) {
+			b, ok := l.domains[domain]
+			if !ok {
+				b = newBucket(l.DomainRecipients, now)
+				l.domains[domain] = b
+			}
+			takes = append(takes, take{b, float64(n), "recipients of " + domain})
+		}
+	}
+
+	var delay time.Duration
+	name := ""
+	for _, t := range takes {
+		if t.b == nil {
+			continue
+		}
+		t.b.advance(now)
+		if d := t.b.delay(t.n); d > delay {
+			delay, name = d, t.name
+		}
+	}
+	if delay > 0 {
+		return delay, name
+	}
+
+	for _, t := range takes {
+		if t.b != nil {
+			t.b.tokens -= t.n
+		}
+	}
+	return 0, ""
+}
+
+// pruneDomains removes the full buckets of the domains,
+// which are the same as new ones.
+func (l *RateLimiter) pruneDomains(now time.Time) {
+	if l.domains == nil {
+		l.domains = make(map[string]*bucket)
+		return
+	}
+	for domain, b := range l.domains {
+		b.advance(now)
+		if b.tokens >= b.limit.burst() {
+			delete(l.domains, domain)
+		}
+	}
+}
+
+// Wait takes a message and its recipients from the limits,
+// waiting until they are allowed or the context is done.
+// If NoWait is set, a *RateLimitError is returned instead of waiting.
+func (l *RateLimiter) Wait(ctx context.Context, rcpt []string) error {
+	for {
+		delay, name := l.reserve(rcpt)
+		if delay == 0 {
+			return nil
+		}
+		if l.NoWait {
+			return &RateLimitError{Limit: name, RetryAfter: delay}
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// TakeBytes takes the size of a sent message from the limit of bytes.
+func (l *RateLimiter) TakeBytes(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.bytes != nil {
+		l.bytes.advance(time.Now())
+		l.bytes.tokens -= float64(n)
+	}
+}
@@ -0,0 +1,139 @@
+package mailx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := &RateLimiter{
+		Messages:         Limit{N: 2, Per: 100 * time.Millisecond},
+		Recipients:       Limit{N: 4, Per: time.Hour},
+		DomainRecipients: Limit{N: 2, Per: time.Hour},
+		NoWait:           true,
+	}
+
+	if err := l.Wait(ctx, []string{"aaa@example.com"}); err != nil {
+		t.Fatalf("wait: %s", err.Error())
+	}
+	if err := l.Wait(ctx, []string{"bbb@example.org"}); err != nil {
+		t.Fatalf("wait: %s", err.Error())
+	}
+	var limitErr *RateLimitError
+	err := l.Wait(ctx, []string{"ccc@example.com"})
+	if !errors.As(err, &limitErr) || limitErr.Limit != "messages" || limitErr.RetryAfter <= 0 {
+		t.Fatalf("expected *RateLimitError of messages, got %v", err)
+	}
+	if !IsTemporary(err) {
+		t.Fatalf("expected temporary error")
+	}
+
+	time.Sleep(limitErr.RetryAfter)
+	err = l.Wait(ctx, []string{"ccc@EXAMPLE.com", "ddd@example.com"})
+	if !errors.As(err, &limitErr) || limitErr.Limit != "recipients of example.com" {
+		t.Fatalf("expected *RateLimitError of example.com, got %v", err)
+	}
+	if err = l.Wait(ctx, []string{"ccc@example.net", "ddd@example.net"}); err != nil {
+		t.Fatalf("wait: %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err = l.Wait(ctx, []string{"eee@example.edu"}); !errors.As(err, &limitErr) || limitErr.Limit != "recipients" {
+		t.Fatalf("expected *RateLimitError of recipients, got %v", err)
+	}
+
+	// larger than the burst, but allowed once the bucket is full
+	l = &RateLimiter{Recipients: Limit{N: 2, Per: time.Hour}, NoWait: true}
+	if err = l.Wait(ctx, []string{"aaa@example.com", "bbb@example.com", "ccc@example.com"}); err != nil {
+		t.Fatalf("wait: %s", err.Error())
+	}
+	if err = l.Wait(ctx, []string{"ddd@example.com"}); !errors.As(err, &limitErr) || limitErr.RetryAfter < 50*time.Minute {
+		t.Fatalf("expected *RateLimitError of recipients, got %v", err)
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := &RateLimiter{
+		Messages: Limit{N: 1, Per: 50 * time.Millisecond},
+		Bytes:    Limit{N: 1000, Per: time.Hour},
+	}
+
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(ctx, []string{"aaa@example.com"}); err != nil {
+			t.Fatalf("wait: %s", err.Error())
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected waiting, elapsed %s", elapsed)
+	}
+
+	// the next message waits for the debt of bytes.
+	l.TakeBytes(1500)
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, []string{"aaa@example.com"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestDialerRateLimiter(t *testing.T) {
+	stubNewSmtpClient := newSmtpClient
+	defer func() { newSmtpClient = stubNewSmtpClient }()
+	newSmtpClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return &mockSmtpClient{map[string]string{}}, nil
+	}
+
+	dialed := 0
+	d := &Dialer{
+		Host: "smtp.example.com",
+		Port: 587,
+		NetDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed++
+			return nil, nil
+		},
+		RateLimiter: &RateLimiter{Messages: Limit{N: 1, Per: time.Hour}, NoWait: true},
+	}
+
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com")
+	m.SetSubject("This is a subject of email.")
+
+	if err := d.Send(context.Background(), m); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+	var limitErr *RateLimitError
+	if err := d.Send(context.Background(), m); !errors.As(err, &limitErr) {
+		t.Fatalf("expected *RateLimitError, got %v", err)
+	}
+	// The limiter is waited for before dialing.
+	if dialed != 1 {
+		t.Fatalf("expected 1 dial, got %d", dialed)
+	}
+}
+
+func TestMultiDialerRateLimiter(t *testing.T) {
+	md, dialed := testMultiDialer(t, nil, "relay1.example.com", "relay2.example.com")
+	md.MaxFailures = 1
+	md.Relays[0].Dialer.RateLimiter = &RateLimiter{Messages: Limit{N: 1, Per: time.Hour}, NoWait: true}
+
+	if err := md.Send(context.Background(), testMultiMessage()); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+	// The local limit is neither failed over nor a failure of the relay.
+	var limitErr *RateLimitError
+	if err := md.Send(context.Background(), testMultiMessage()); !errors.As(err, &limitErr) {
+		t.Fatalf("expected *RateLimitError, got %v", err)
+	}
+	if len(*dialed) != 1 {
+		t.Fatalf("invalid dialed relays: %v", *dialed)
+	}
+	if healthy := md.Healthy(); !healthy[0] || !healthy[1] {
+		t.Fatalf("invalid health: %v", healthy)
+	}
+}
@@ -0,0 +1,76 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// @author valor.
+
+// maxRawLineLength is the maximum length of a line of the raw message,
+// excluding the CRLF, see RFC 5321 - 4.5.3.1.6.
+const maxRawLineLength = 998
+
+// normalizeRaw converts the bare LF of the message to CRLF,
+// and checks the length of its lines. A bare CR is kept as is,
+// since it is not a line ending. The message is ended with a CRLF, if not.
+func normalizeRaw(raw []byte) ([]byte, error) {
+	b := bytes.NewBuffer(make([]byte, 0, len(raw)+len(raw)/32+2))
+	line, length := 1, 0
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c == '\r' && i+1 < len(raw) && raw[i+1] == '\n' {
+			continue
+		}
+		if c != '\n' {
+			if length++; length > maxRawLineLength {
+				return nil, errors.New("line " + strconv.Itoa(line) + " of raw message exceeds " +
+					strconv.Itoa(maxRawLineLength) + " octets")
+			}
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("\r\n")
+		line, length = line+1, 0
+	}
+	if length > 0 {
+		b.WriteString("\r\n")
+	}
+	return b.Bytes(), nil
+}
+
+// SendRaw sends a message which is already rendered, e.g. signed by DKIM,
+// to the recipients. If from is empty, the username of the Dialer is used.
+//
+// The bare LF are converted to CRLF, and the lines starting with a dot
+// are dot-stuffed while sending, otherwise the message is sent byte-for-byte,
+// including a bare CR. It is read and checked before sending, so that a line
+// longer than 998 octets fails before the MAIL command.
+func (s *Sender) SendRaw(from string, to []string, r io.Reader) error {
+	_, err := s.SendRawContext(context.Background(), from, to, r)
+	return err
+}
+
+// SendRawContext is like SendRaw, but returns the receipt, and the context
+// interrupts waiting for the rate limiter, if any.
+func (s *Sender) SendRawContext(ctx context.Context, from string, to []string, r io.Reader) (*Receipt, error) {
+	if len(to) == 0 {
+		return nil, errors.New("empty email rcpt")
+	}
+	if from == "" {
+		from = s.from
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if raw, err = normalizeRaw(raw); err != nil {
+		return nil, err
+	}
+	return s.send(ctx, from, to, bytes.NewReader(raw))
+}
@@ -0,0 +1,115 @@
+package mailx
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeRaw(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"", ""},
+		{"a\r\nb\r\n", "a\r\nb\r\n"},
+		{"a\nb", "a\r\nb\r\n"},
+		{"a\rb\r\n\r\n", "a\rb\r\n\r\n"},
+		{"a\r", "a\r\r\n"},
+		{"a\r\r\nb", "a\r\r\nb\r\n"},
+		{"\xff.\n", "\xff.\r\n"},
+	}
+	for i, tt := range tests {
+		got, err := normalizeRaw([]byte(tt.raw))
+		if err != nil || string(got) != tt.want {
+			t.Fatalf("#%d: got %q, %v, want %q", i, got, err, tt.want)
+		}
+	}
+
+	long := strings.Repeat("x", maxRawLineLength)
+	if _, err := normalizeRaw([]byte("a\n" + long + "\r\n")); err != nil {
+		t.Fatalf("line of %d octets: %s", maxRawLineLength, err.Error())
+	}
+	if _, err := normalizeRaw([]byte("a\n" + long + "x\r\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("line of %d octets: %v", maxRawLineLength+1, err)
+	}
+}
+
+func TestSendRaw(t *testing.T) {
+	c, s := net.Pipe()
+	lines := make(chan []string, 1)
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		text := textproto.NewConn(s)
+		err := playScript(text, []string{
+			"S: 220 localhost ESMTP",
+			"C: EHLO localhost",
+			"S: 250 localhost",
+			"C: MAIL FROM:<alex@example.com>",
+			"S: 250 2.1.0 Ok",
+			"C: RCPT TO:<aaa@example.com>",
+			"S: 250 2.1.5 Ok",
+			"C: DATA",
+			"S: 354 End data with <CR><LF>.<CR><LF>",
+		})
+		if err != nil {
+			done <- err
+			return
+		}
+		// Read the lines as sent, without undoing the dot-stuffing.
+		var data []string
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				done <- err
+				return
+			}
+			if line == "." {
+				break
+			}
+			data = append(data, line)
+		}
+		lines <- data
+		done <- playScript(text, []string{
+			"S: 250 2.0.0 Ok: queued as 4F2A1",
+			"C: QUIT",
+			"S: 221 2.0.0 Bye",
+		})
+	}()
+
+	client, err := newClient(c, "localhost", false)
+	if err != nil {
+		t.Fatalf("new client: %s", err.Error())
+	}
+	sender := &Sender{smtpClient: client, from: "alex@example.com"}
+
+	raw := "DKIM-Signature: v=1; b=abc\nSubject: raw\n\n.hidden\n..two\nbare\rCR\nend"
+	r, err := sender.SendRawContext(context.Background(), "", []string{"aaa@example.com"}, strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("send raw: %s", err.Error())
+	}
+	if r.QueueID != "4F2A1" || r.MessageID != "" || r.Size != int64(len(raw)+8) {
+		t.Fatalf("receipt: %+v", r)
+	}
+	sender.Close()
+	if err = <-done; err != nil {
+		t.Fatalf("server: %s", err.Error())
+	}
+
+	want := []string{"DKIM-Signature: v=1; b=abc", "Subject: raw", "", "..hidden", "...two", "bare\rCR", "end"}
+	if got := <-lines; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// The message is checked before sending, the Sender has no client.
+	long := strings.Repeat("x", maxRawLineLength+1)
+	err = (&Sender{}).SendRaw("alex@example.com", []string{"aaa@example.com"}, strings.NewReader(long))
+	if err == nil {
+		t.Fatalf("send raw: %v", err)
+	}
+	if err = (&Sender{}).SendRaw("alex@example.com", nil, strings.NewReader(raw)); err == nil {
+		t.Fatal("send raw: want error without rcpt")
+	}
+}
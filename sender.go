@@ -1,19 +1,134 @@
 package mailx
 
 import (
+	"context"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // @author valor.
 
-// Sender sends emails via *smtp.Client
+// Sender sends emails via the SMTP or LMTP client
 type Sender struct {
 	smtpClient
-	from string
+	from     string
+	limiter  *RateLimiter
+	observer Observer
+	// sent is the number of emails sent on the connection.
+	sent int
+	// reserved is whether the limiter was waited for the next email
+	// before dialing, see Dialer.dialReserved.
+	reserved bool
+}
+
+// RcptStatus is the reply of the server for a recipient.
+type RcptStatus struct {
+	// Rcpt is the address of the recipient.
+	Rcpt string
+	// Code is the reply code, e.g. 250.
+	Code int
+	// Msg is the reply text.
+	Msg string
+}
+
+// OK reports whether the message was delivered to the recipient.
+func (s RcptStatus) OK() bool {
+	return s.Code/100 == 2
+}
+
+// Receipt is the result of sending an email.
+type Receipt struct {
+	// MessageID is the header 'MESSAGE-ID' of the email which is sent,
+	// or empty if the email is rendered already, see Sender.SendRaw.
+	MessageID string
+	// Accepted is the recipients accepted by the RCPT commands.
+	Accepted []string
+	// Size is the number of bytes of the message sent after DATA.
+	Size int64
+	// Start is the time when the MAIL command was sent.
+	Start time.Time
+	// Duration is the time taken from MAIL to the reply to the end of DATA.
+	Duration time.Duration
+	// Reply is the reply text of the server to the end of DATA,
+	// e.g. "2.0.0 Ok: queued as 4F2A1".
+	Reply string
+	// QueueID is the id of the message in the server's queue,
+	// parsed from the Reply, or empty if unknown.
+	QueueID string
+	// Rcpt is the reply of the server for each recipient
+	// after the DATA command, in LMTP mode.
+	Rcpt []RcptStatus
+}
+
+// parseQueueID parses the queue id from the reply to the end of DATA,
+// in the formats of the common MTAs:
+//
+//	Postfix:  "2.0.0 Ok: queued as 4F2A1"
+//	Exim:     "OK id=1tWvXy-0001aB-Cd"
+//	Sendmail: "2.0.0 4BJ3Kx1234 Message accepted for delivery"
+func parseQueueID(reply string) string {
+	reply = strings.TrimSpace(reply)
+	if i := strings.Index(reply, "queued as "); i >= 0 {
+		fields := strings.Fields(reply[i+len("queued as "):])
+		if len(fields) > 0 {
+			return strings.TrimRight(fields[0], ".,;")
+		}
+		return ""
+	}
+
+	fields := strings.Fields(reply)
+	for _, field := range fields {
+		if strings.HasPrefix(field, "id=") {
+			return strings.TrimRight(field[3:], ".,;")
+		}
+	}
+	if len(fields) > 3 && fields[2] == "Message" && fields[3] == "accepted" {
+		return fields[1]
+	}
+	return ""
+}
+
+// RcptError reports the recipients to which the message was not delivered.
+type RcptError struct {
+	Rcpt []RcptStatus
+}
+
+// Error implements error.
+func (e *RcptError) Error() string {
+	b := &strings.Builder{}
+	b.WriteString("failed to deliver to recipients:")
+	for _, s := range e.Rcpt {
+		b.WriteString(" <" + s.Rcpt + "> " + strconv.Itoa(s.Code) + " " + s.Msg + ";")
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+type rcptStatuser interface {
+	rcptStatus() []RcptStatus
+}
+
+type dataReplier interface {
+	dataReply() string
 }
 
 // Send sends the given emails.
 func (s *Sender) Send(m *Message) error {
+	_, err := s.SendWithReceipt(m)
+	return err
+}
+
+// SendWithReceipt sends the given emails and returns the receipt.
+// In LMTP mode, a *RcptError is returned along with the receipt
+// if the message was not delivered to some recipients.
+func (s *Sender) SendWithReceipt(m *Message) (*Receipt, error) {
+	return s.SendContext(context.Background(), m)
+}
+
+// SendContext is like SendWithReceipt, but the context
+// interrupts waiting for the rate limiter, if any.
+func (s *Sender) SendContext(ctx context.Context, m *Message) (*Receipt, error) {
 	from, err := m.sender()
 	if err != nil {
 		from = s.from
@@ -22,30 +137,98 @@ func (s *Sender) Send(m *Message) error {
 
 	rcpt, err := m.rcpt()
 	if err != nil {
-		return err
+		return nil, &messageError{err: err}
 	}
 
-	return s.send(from, rcpt, m)
+	return s.send(ctx, from, rcpt, m)
 }
 
 // send sends a message implements io.WriterTo
-func (s *Sender) send(from string, to []string, msg io.WriterTo) error {
-	if err := s.Mail(from); err != nil {
-		return err
+func (s *Sender) send(ctx context.Context, from string, to []string, msg io.WriterTo) (r *Receipt, err error) {
+	obs := s.observer
+	if obs == nil {
+		obs = NopObserver{}
+	}
+	start, reused := time.Now(), s.sent > 0
+	defer func() {
+		s.sent++
+		obs.OnSendDone(r, reused, time.Since(start), err)
+	}()
+
+	if s.limiter != nil && !s.reserved {
+		if err = s.limiter.Wait(ctx, to); err != nil {
+			return nil, err
+		}
+	}
+	s.reserved = false
+
+	r = &Receipt{Start: time.Now()}
+	if m, ok := msg.(*Message); ok {
+		// The generated 'MESSAGE-ID' is fixed for this sending only.
+		if m, r.MessageID, err = m.withMessageID(); err != nil {
+			return nil, &messageError{err: err}
+		}
+		eightBitMIME, _ := s.Extension("8BITMIME")
+		msg = messageWriter{m: m, ctx: ctx, sevenBit: !eightBitMIME}
+	}
+
+	err = s.Mail(from)
+	obs.OnMail(from, time.Since(r.Start), err)
+	if err != nil {
+		return nil, err
 	}
 
+	r.Accepted = make([]string, 0, len(to))
 	for _, addr := range to {
-		if err := s.Rcpt(addr); err != nil {
-			return err
+		t := time.Now()
+		err = s.Rcpt(addr)
+		obs.OnRcpt(addr, time.Since(t), err)
+		if err != nil {
+			return nil, err
 		}
+		r.Accepted = append(r.Accepted, addr)
 	}
 
+	t := time.Now()
+	if err = s.data(msg, r); err != nil {
+		obs.OnData(r.Size, time.Since(t), err)
+		return nil, err
+	}
+	obs.OnData(r.Size, time.Since(t), nil)
+	r.Duration = time.Since(r.Start)
+
+	if c, ok := s.smtpClient.(dataReplier); ok {
+		r.Reply = c.dataReply()
+		r.QueueID = parseQueueID(r.Reply)
+	}
+	if c, ok := s.smtpClient.(rcptStatuser); ok {
+		r.Rcpt = c.rcptStatus()
+	}
+
+	var failed []RcptStatus
+	for _, status := range r.Rcpt {
+		if !status.OK() {
+			failed = append(failed, status)
+		}
+	}
+	if len(failed) > 0 {
+		return r, &RcptError{Rcpt: failed}
+	}
+	return r, nil
+}
+
+// data sends the DATA command and the message.
+func (s *Sender) data(msg io.WriterTo, r *Receipt) error {
 	w, err := s.Data()
 	if err != nil {
 		return err
 	}
 
-	if _, err = msg.WriteTo(w); err != nil {
+	r.Size, err = msg.WriteTo(w)
+	if s.limiter != nil {
+		s.limiter.TakeBytes(r.Size)
+	}
+	if err != nil {
 		w.Close()
 		return err
 	}
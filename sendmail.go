@@ -0,0 +1,193 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// @author valor.
+
+const defaultSendmailPath = "/usr/sbin/sendmail"
+
+// SendmailTransport sends emails by piping them to the sendmail binary.
+//
+// The envelope is passed as arguments: "-f <sender> -- <rcpt>...",
+// instead of reading the recipients from the headers with "-t",
+// since the header 'BCC' is never written to the message.
+type SendmailTransport struct {
+	// Path is the path of the sendmail binary.
+	// If empty, "/usr/sbin/sendmail" is used.
+	Path string
+	// Args are the arguments passed before the envelope.
+	// If nil, "-i" is used, so that a line with a single dot
+	// doesn't end the message.
+	Args []string
+}
+
+// SendmailError is returned when the sendmail binary fails.
+type SendmailError struct {
+	// Path is the path of the sendmail binary.
+	Path string
+	// ExitCode is the exit status of sendmail,
+	// or -1 if it didn't exit normally.
+	ExitCode int
+	// Stderr is the output of sendmail to stderr.
+	Stderr string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements error.
+func (e *SendmailError) Error() string {
+	s := "sendmail: " + e.Path
+	if e.ExitCode >= 0 {
+		s += ": exit status " + strconv.Itoa(e.ExitCode)
+	} else if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		s += ": " + stderr
+	}
+	return s
+}
+
+// Unwrap returns the underlying error.
+func (e *SendmailError) Unwrap() error {
+	return e.Err
+}
+
+func (t *SendmailTransport) path() string {
+	if t.Path == "" {
+		return defaultSendmailPath
+	}
+	return t.Path
+}
+
+func (t *SendmailTransport) args(from string, rcpt []string) []string {
+	args := t.Args
+	if args == nil {
+		args = []string{"-i"}
+	}
+
+	envelope := make([]string, 0, len(args)+len(rcpt)+3)
+	envelope = append(envelope, args...)
+	if from != "" {
+		envelope = append(envelope, "-f", from)
+	}
+	envelope = append(envelope, "--")
+	return append(envelope, rcpt...)
+}
+
+// Send implements Transport.
+// The process of sendmail is killed if the context is done.
+func (t *SendmailTransport) Send(ctx context.Context, m *Message) error {
+	from, _ := m.sender()
+	rcpt, err := m.rcpt()
+	if err != nil {
+		return err
+	}
+	// Do not let the addresses be parsed as options.
+	if strings.HasPrefix(from, "-") {
+		return errors.New("invalid email address: " + from)
+	}
+	for _, addr := range rcpt {
+		if strings.HasPrefix(addr, "-") {
+			return errors.New("invalid email address: " + addr)
+		}
+	}
+
+	path := t.path()
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, path, t.args(from, rcpt)...)
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return &SendmailError{Path: path, ExitCode: -1, Err: err}
+	}
+	if err = cmd.Start(); err != nil {
+		return &SendmailError{Path: path, ExitCode: -1, Err: err}
+	}
+
+	// sendmail expects the local line endings.
+	lw := &lfWriter{w: stdin}
+	_, werr := m.WriteTo(lw)
+	if werr == nil {
+		werr = lw.Close()
+	}
+	stdin.Close()
+	if werr != nil {
+		cmd.Process.Kill()
+	}
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+		return &SendmailError{Path: path, ExitCode: exitErr.ExitCode(), Stderr: stderr.String(), Err: err}
+	}
+	if werr != nil {
+		return werr
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return &SendmailError{Path: path, ExitCode: -1, Stderr: stderr.String(), Err: err}
+	}
+	return nil
+}
+
+// lfWriter converts CRLF line endings to LF.
+type lfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+// Write implements io.Writer
+func (w *lfWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	buf := make([]byte, 0, len(p)+1)
+	if w.cr {
+		// The last byte of the previous write was a pending CR.
+		if p[0] != '\n' {
+			buf = append(buf, '\r')
+		}
+		w.cr = false
+	}
+	for i, b := range p {
+		if b == '\r' {
+			if i == len(p)-1 {
+				w.cr = true
+				continue
+			}
+			if p[i+1] == '\n' {
+				continue
+			}
+		}
+		buf = append(buf, b)
+	}
+
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the CR which is still pending at the end,
+// it doesn't close the underlying writer.
+func (w *lfWriter) Close() error {
+	if !w.cr {
+		return nil
+	}
+	w.cr = false
+	_, err := w.w.Write([]byte{'\r'})
+	return err
+}
@@ -0,0 +1,135 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestSendmailHelperProcess isn't a real test.
+// It is run as the sendmail binary by the tests below.
+func TestSendmailHelperProcess(t *testing.T) {
+	out := os.Getenv("MAILX_SENDMAIL_OUT")
+	if out == "" {
+		return
+	}
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	stdin, _ := io.ReadAll(os.Stdin)
+	content := strings.Join(args[1:], " ") + "\n" + string(stdin)
+	os.WriteFile(out, []byte(content), 0600)
+
+	if code, _ := strconv.Atoi(os.Getenv("MAILX_SENDMAIL_EXIT")); code != 0 {
+		fmt.Fprintln(os.Stderr, "sendmail: fatal: recipient rejected")
+		os.Exit(code)
+	}
+	os.Exit(0)
+}
+
+func testSendmail(t *testing.T, exitCode int) (string, error) {
+	out := filepath.Join(t.TempDir(), "sendmail.out")
+	os.Setenv("MAILX_SENDMAIL_OUT", out)
+	defer os.Unsetenv("MAILX_SENDMAIL_OUT")
+	os.Setenv("MAILX_SENDMAIL_EXIT", strconv.Itoa(exitCode))
+	defer os.Unsetenv("MAILX_SENDMAIL_EXIT")
+
+	tr := &SendmailTransport{
+		Path: os.Args[0],
+		Args: []string{"-test.run=^TestSendmailHelperProcess$", "--", "-i"},
+	}
+
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com")
+	m.SetBcc("bbb@example.com")
+	m.SetSubject("This is a subject of email.")
+	m.SetPlainBody("This is a text/plain body.")
+
+	err := tr.Send(context.Background(), m)
+	b, _ := os.ReadFile(out)
+	return string(b), err
+}
+
+func TestSendmailTransport(t *testing.T) {
+	out, err := testSendmail(t, 0)
+	if err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+
+	lines := strings.SplitN(out, "\n", 2)
+	if lines[0] != "-i -f alex@example.com -- aaa@example.com bbb@example.com" {
+		t.Fatalf("invalid arguments, got '%s'", lines[0])
+	}
+	if strings.Contains(lines[1], "\r") {
+		t.Fatalf("unexpected CRLF line endings")
+	}
+	if !strings.Contains(lines[1], "SUBJECT: ") {
+		t.Fatalf("invalid message: %s", lines[1])
+	}
+}
+
+func TestSendmailTransportErr(t *testing.T) {
+	_, err := testSendmail(t, 67)
+
+	var sendmailErr *SendmailError
+	if !errors.As(err, &sendmailErr) {
+		t.Fatalf("expected *SendmailError, got %v", err)
+	}
+	if sendmailErr.ExitCode != 67 || !strings.Contains(sendmailErr.Stderr, "recipient rejected") {
+		t.Fatalf("invalid error: %s", sendmailErr.Error())
+	}
+
+	tr := &SendmailTransport{Path: filepath.Join(t.TempDir(), "sendmail")}
+	m := NewMessage()
+	m.SetTo("aaa@example.com")
+	m.SetSubject("This is a subject of email.")
+	if err = tr.Send(context.Background(), m); !errors.As(err, &sendmailErr) || sendmailErr.ExitCode != -1 {
+		t.Fatalf("expected *SendmailError, got %v", err)
+	}
+
+	m.SetTo("-oQ/tmp", "aaa@example.com")
+	if err = tr.Send(context.Background(), m); err == nil {
+		t.Fatalf("expected error for invalid address")
+	}
+}
+
+func TestLFWriter(t *testing.T) {
+	b := &bytes.Buffer{}
+	w := &lfWriter{w: b}
+	for _, s := range []string{"a\r\nb\r", "\nc\r", "d\r\n", "", "\r", "\r\n"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("write: %s", err.Error())
+		}
+	}
+	if got := b.String(); got != "a\nb\nc\rd\n\r\n" {
+		t.Fatalf("invalid output, got %q", got)
+	}
+
+	// The pending CR at the end is written on Close.
+	b.Reset()
+	w = &lfWriter{w: b}
+	for _, s := range []string{"a\r\nb", "\r"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("write: %s", err.Error())
+		}
+	}
+	if got := b.String(); got != "a\nb" {
+		t.Fatalf("invalid output before close, got %q", got)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %s", err.Error())
+	}
+	if got := b.String(); got != "a\nb\r" {
+		t.Fatalf("invalid output, got %q", got)
+	}
+}
@@ -0,0 +1,377 @@
+package mailx
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// @author valor.
+
+// The object identifiers of CMS, see RFC 5652, RFC 5754 and RFC 3565.
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidAttrContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAES256CBC       = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo cmsContentInfo
+	Certificates     asn1.RawValue `asn1:"optional"`
+	SignerInfos      asn1.RawValue
+}
+
+type cmsRecipientInfo struct {
+	Version                int
+	RID                    cmsIssuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type cmsEncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue
+}
+
+type cmsEnvelopedData struct {
+	Version              int
+	RecipientInfos       asn1.RawValue
+	EncryptedContentInfo cmsEncryptedContentInfo
+}
+
+// derSet encodes the DER encodings as a 'SET OF', sorted as required by DER.
+func derSet(elems ...[]byte) ([]byte, error) {
+	sorted := make([][]byte, len(elems))
+	copy(sorted, elems)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	return asn1.Marshal(asn1.RawValue{
+		Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(sorted, nil),
+	})
+}
+
+// derTagged encodes the content as a constructed, context-specific tag.
+func derTagged(tag int, content []byte) asn1.RawValue {
+	return asn1.RawValue{
+		Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: content,
+	}
+}
+
+// contentInfo wraps the content in a CMS ContentInfo.
+func contentInfo(contentType asn1.ObjectIdentifier, content []byte) ([]byte, error) {
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: contentType,
+		Content:     derTagged(0, content),
+	})
+}
+
+func issuerAndSerial(cert *x509.Certificate) cmsIssuerAndSerial {
+	return cmsIssuerAndSerial{
+		Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+		SerialNumber: cert.SerialNumber,
+	}
+}
+
+// SMIMESigner signs the messages with S/MIME, see RFC 8551.
+type SMIMESigner struct {
+	// Certificate is the certificate of the signer,
+	// which is included in the signature.
+	Certificate *x509.Certificate
+	// Key is the private key of the certificate,
+	// *rsa.PrivateKey or *ecdsa.PrivateKey.
+	Key crypto.Signer
+	// Intermediates is the optional intermediate certificates,
+	// which are included in the signature.
+	Intermediates []*x509.Certificate
+}
+
+func (s *SMIMESigner) signatureAlgorithm() (pkix.AlgorithmIdentifier, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PrivateKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	default:
+		return pkix.AlgorithmIdentifier{}, errors.New("unsupported key of S/MIME")
+	}
+}
+
+// Sign returns the detached signature of the content, which is a DER
+// encoded PKCS #7 (CMS) SignedData with SHA-256, see RFC 5652 - 5.
+func (s *SMIMESigner) Sign(content []byte) ([]byte, error) {
+	if s.Certificate == nil {
+		return nil, errors.New("empty certificate of S/MIME")
+	}
+	sigAlg, err := s.signatureAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(content)
+	attrs := make([][]byte, 0, 3)
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidAttrContentType, oidData},
+		{oidAttrSigningTime, time.Now().UTC()},
+		{oidAttrMessageDigest, digest[:]},
+	} {
+		v, err := asn1.Marshal(a.value)
+		if err != nil {
+			return nil, err
+		}
+		values, err := derSet(v)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(cmsAttribute{Type: a.oid, Values: asn1.RawValue{FullBytes: values}})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+
+	// The signature is computed over the DER encoding of the signed
+	// attributes with the tag 'SET OF', see RFC 5652 - 5.4.
+	signedAttrs, err := derSet(attrs...)
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256(signedAttrs)
+	signature, err := s.Key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	// The signed attributes are encoded with the tag [0] IMPLICIT instead.
+	signedAttrs[0] = asn1.ClassContextSpecific<<6 | 0x20
+
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	signerInfo, err := asn1.Marshal(cmsSignerInfo{
+		Version:            1,
+		SID:                issuerAndSerial(s.Certificate),
+		DigestAlgorithm:    sha256Alg,
+		SignedAttrs:        asn1.RawValue{FullBytes: signedAttrs},
+		SignatureAlgorithm: sigAlg,
+		Signature:          signature,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signerInfos, err := derSet(signerInfo)
+	if err != nil {
+		return nil, err
+	}
+	digestAlg, err := asn1.Marshal(sha256Alg)
+	if err != nil {
+		return nil, err
+	}
+	digestAlgs, err := derSet(digestAlg)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := s.Certificate.Raw
+	for _, cert := range s.Intermediates {
+		certs = append(certs[:len(certs):len(certs)], cert.Raw...)
+	}
+	signedData, err := asn1.Marshal(cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{FullBytes: digestAlgs},
+		EncapContentInfo: cmsContentInfo{ContentType: oidData},
+		Certificates:     derTagged(0, certs),
+		SignerInfos:      asn1.RawValue{FullBytes: signerInfos},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contentInfo(oidSignedData, signedData)
+}
+
+// encryptSMIME encrypts the content with AES-256-CBC for the recipients,
+// and returns a DER encoded PKCS #7 (CMS) EnvelopedData, see RFC 5652 - 6.
+// The content-encryption key is encrypted by RSA (PKCS #1 v1.5).
+func encryptSMIME(content []byte, recipients []*x509.Certificate) ([]byte, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	infos := make([][]byte, 0, len(recipients))
+	for _, cert := range recipients {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("unsupported key of S/MIME recipient: " + cert.Subject.String())
+		}
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, err
+		}
+		info, err := asn1.Marshal(cmsRecipientInfo{
+			Version:                0,
+			RID:                    issuerAndSerial(cert),
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	recipientInfos, err := derSet(infos...)
+	if err != nil {
+		return nil, err
+	}
+
+	// PKCS #7 padding, see RFC 5652 - 6.3.
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted := make([]byte, len(content)+padding)
+	copy(encrypted, content)
+	copy(encrypted[len(content):], bytes.Repeat([]byte{byte(padding)}, padding))
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	params, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	envelopedData, err := asn1.Marshal(cmsEnvelopedData{
+		Version:        0,
+		RecipientInfos: asn1.RawValue{FullBytes: recipientInfos},
+		EncryptedContentInfo: cmsEncryptedContentInfo{
+			ContentType: oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  oidAES256CBC,
+				Parameters: asn1.RawValue{FullBytes: params},
+			},
+			// [0] IMPLICIT OCTET STRING
+			EncryptedContent: asn1.RawValue{
+				Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contentInfo(oidEnvelopedData, envelopedData)
+}
+
+// writeBase64 writes the data encoded by base64 in lines.
+func writeBase64(w io.Writer, data []byte) (int, error) {
+	b := &bytes.Buffer{}
+	partWriter := multipartWriter(b)
+	if _, err := partWriter.Write(data); err != nil {
+		return 0, err
+	}
+	partWriter.Close()
+	return w.Write(b.Bytes())
+}
+
+// signSMIME wraps the MIME entity in 'multipart/signed', see RFC 8551 - 3.5.
+// The entity is signed exactly as it is written.
+func signSMIME(s *SMIMESigner, entity []byte, w io.Writer) (int, error) {
+	signature, err := s.Sign(entity)
+	if err != nil {
+		return 0, errors.New("failed to sign S/MIME: " + err.Error())
+	}
+
+	boundary, err := newBoundary()
+	if err != nil {
+		return 0, err
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteString("Content-Type: multipart/signed;\r\n")
+	b.WriteString(" protocol=\"application/pkcs7-signature\"; micalg=sha-256;\r\n")
+	b.WriteString(" boundary=\"" + boundary + "\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("--" + boundary + "\r\n")
+	b.Write(entity)
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	b.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n")
+	b.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n")
+	b.WriteString("\r\n")
+	if _, err = writeBase64(b, signature); err != nil {
+		return 0, err
+	}
+	b.WriteString("--" + boundary + "--\r\n")
+	return w.Write(b.Bytes())
+}
+
+// encryptSMIMEEntity wraps the MIME entity in 'application/pkcs7-mime'
+// with the enveloped-data, see RFC 8551 - 3.3.
+func encryptSMIMEEntity(recipients []*x509.Certificate, entity []byte, w io.Writer) (int, error) {
+	enveloped, err := encryptSMIME(entity, recipients)
+	if err != nil {
+		return 0, errors.New("failed to encrypt S/MIME: " + err.Error())
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteString("Content-Type: application/pkcs7-mime;\r\n")
+	b.WriteString(" smime-type=enveloped-data; name=\"smime.p7m\"\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n")
+	b.WriteString("Content-Disposition: attachment; filename=\"smime.p7m\"\r\n")
+	b.WriteString("\r\n")
+	if _, err = writeBase64(b, enveloped); err != nil {
+		return 0, err
+	}
+	return w.Write(b.Bytes())
+}
@@ -0,0 +1,288 @@
+package mailx
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// @author valor.
+
+func testSMIMECertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: "alex"},
+		EmailAddresses: []string{"alex@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %s", err.Error())
+	}
+	return cert
+}
+
+// testSMIMEVerify verifies the detached signature of the content.
+func testSMIMEVerify(content, signature []byte) error {
+	var ci cmsContentInfo
+	if _, err := asn1.Unmarshal(signature, &ci); err != nil {
+		return err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return errors.New("not signed data: " + ci.ContentType.String())
+	}
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(sd.Certificates.Bytes)
+	if err != nil {
+		return err
+	}
+	var si cmsSignerInfo
+	if _, err = asn1.Unmarshal(sd.SignerInfos.Bytes, &si); err != nil {
+		return err
+	}
+	if si.SID.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		return errors.New("signer not found: " + si.SID.SerialNumber.String())
+	}
+
+	digest := sha256.Sum256(content)
+	if !bytes.Contains(si.SignedAttrs.Bytes, digest[:]) {
+		return errors.New("message digest mismatch")
+	}
+	signedAttrs := append([]byte{}, si.SignedAttrs.FullBytes...)
+	signedAttrs[0] = 0x31
+	algorithm := x509.SHA256WithRSA
+	if si.SignatureAlgorithm.Algorithm.Equal(oidECDSAWithSHA256) {
+		algorithm = x509.ECDSAWithSHA256
+	}
+	return cert.CheckSignature(algorithm, signedAttrs, si.Signature)
+}
+
+// testSMIMEDecrypt decrypts the enveloped data by the key of recipient.
+func testSMIMEDecrypt(t *testing.T, enveloped []byte, key *rsa.PrivateKey, cert *x509.Certificate) []byte {
+	var ci cmsContentInfo
+	if _, err := asn1.Unmarshal(enveloped, &ci); err != nil || !ci.ContentType.Equal(oidEnvelopedData) {
+		t.Fatalf("unmarshal content info: %v", err)
+	}
+	var ed cmsEnvelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		t.Fatalf("unmarshal enveloped data: %s", err.Error())
+	}
+
+	var contentKey []byte
+	rest := ed.RecipientInfos.Bytes
+	for len(rest) > 0 {
+		var ri cmsRecipientInfo
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &ri); err != nil {
+			t.Fatalf("unmarshal recipient info: %s", err.Error())
+		}
+		if ri.RID.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			continue
+		}
+		if contentKey, err = rsa.DecryptPKCS1v15(rand.Reader, key, ri.EncryptedKey); err != nil {
+			t.Fatalf("decrypt key: %s", err.Error())
+		}
+	}
+	if contentKey == nil {
+		t.Fatalf("recipient not found: %s", cert.SerialNumber)
+	}
+
+	var iv []byte
+	eci := ed.EncryptedContentInfo
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		t.Fatalf("unmarshal iv: %s", err.Error())
+	}
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		t.Fatalf("new cipher: %s", err.Error())
+	}
+	content := append([]byte{}, eci.EncryptedContent.Bytes...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, content)
+	return content[:len(content)-int(content[len(content)-1])]
+}
+
+// testSMIMEBody returns the Content-Type and the body of the message.
+func testSMIMEBody(t *testing.T, raw []byte) (string, map[string]string, []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("read message: %s", err.Error())
+	}
+	if msg.Header.Get("Subject") != "This is a subject of email." {
+		t.Fatalf("subject: %s", msg.Header.Get("Subject"))
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse media type: %s", err.Error())
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatalf("read body: %s", err.Error())
+	}
+	return mediaType, params, body
+}
+
+// testSMIMESigned checks the 'multipart/signed' entity,
+// and returns the signed one and its signature.
+func testSMIMESigned(t *testing.T, mediaType string, params map[string]string, body []byte) ([]byte, []byte) {
+	if mediaType != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+		t.Fatalf("content type: %s %v", mediaType, params)
+	}
+	// The signed entity is the raw bytes of the first part.
+	delimiter := "--" + params["boundary"]
+	parts := strings.Split(string(body), "\r\n"+delimiter)
+	content := []byte(strings.TrimPrefix(parts[0], delimiter+"\r\n"))
+
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	if _, err := r.NextPart(); err != nil {
+		t.Fatalf("next part: %s", err.Error())
+	}
+	p, err := r.NextPart()
+	if err != nil {
+		t.Fatalf("next part: %s", err.Error())
+	}
+	if p.Header.Get("Content-Type") != `application/pkcs7-signature; name="smime.p7s"` {
+		t.Fatalf("content type of signature: %s", p.Header.Get("Content-Type"))
+	}
+	b, _ := ioutil.ReadAll(p)
+	signature, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(b), "\r\n", ""))
+	if err != nil {
+		t.Fatalf("decode signature: %s", err.Error())
+	}
+	if err = testSMIMEVerify(content, signature); err != nil {
+		t.Fatalf("verify signature: %s", err.Error())
+	}
+	return content, signature
+}
+
+func TestSMIMESign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %s", err.Error())
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ECDSA key: %s", err.Error())
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		m := testTraceMessage()
+		m.AttachMessage("report.eml", strings.NewReader(testForwarded+"Grüße\n"))
+		m.SetSMIMESigner(&SMIMESigner{
+			Certificate: testSMIMECertificate(t, key),
+			Key:         key,
+		})
+		b := &bytes.Buffer{}
+		if _, err = m.WriteTo(b); err != nil {
+			t.Fatalf("write message: %s", err.Error())
+		}
+
+		mediaType, params, body := testSMIMEBody(t, b.Bytes())
+		content, signature := testSMIMESigned(t, mediaType, params, body)
+		if !bytes.HasPrefix(content, []byte("Content-Type: multipart/mixed;\r\n")) ||
+			!bytes.Contains(content, []byte("VGhpcyBpcyBhIHRleHQvcGxhaW4gYm9k")) {
+			t.Fatalf("signed content:\n%s", content)
+		}
+		// The signed content is in 7bit.
+		if !bytes.Contains(content, []byte("Content-Type: application/octet-stream\r\n"+
+			"Content-Disposition: attachment; filename=\"report.eml\"\r\n"+
+			"Content-Transfer-Encoding: base64\r\n")) {
+			t.Fatalf("signed content:\n%s", content)
+		}
+
+		// Any modification of the signed content breaks the signature.
+		tampered := bytes.Replace(content, []byte("VGhpcyBpcyBh"), []byte("VGhpcyBpcyBi"), 1)
+		if err = testSMIMEVerify(tampered, signature); err == nil {
+			t.Fatalf("tampered content is verified")
+		}
+	}
+}
+
+func TestSMIMEEncrypt(t *testing.T) {
+	signerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ECDSA key: %s", err.Error())
+	}
+	signer := &SMIMESigner{
+		Certificate: testSMIMECertificate(t, signerKey),
+		Key:         signerKey,
+	}
+	keys := make([]*rsa.PrivateKey, 2)
+	certs := make([]*x509.Certificate, 2)
+	for i := range keys {
+		if keys[i], err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatalf("generate RSA key: %s", err.Error())
+		}
+		certs[i] = testSMIMECertificate(t, keys[i])
+	}
+
+	for _, sign := range []bool{false, true} {
+		m := testTraceMessage()
+		if sign {
+			m.SetSMIMESigner(signer)
+		}
+		m.SetSMIMERecipients(certs...)
+		b := &bytes.Buffer{}
+		if _, err = m.WriteTo(b); err != nil {
+			t.Fatalf("write message: %s", err.Error())
+		}
+		if bytes.Contains(b.Bytes(), []byte("VGhpcyBpcyBhIHRleHQvcGxhaW4gYm9k")) {
+			t.Fatalf("body is not encrypted:\n%s", b.String())
+		}
+
+		mediaType, params, body := testSMIMEBody(t, b.Bytes())
+		if mediaType != "application/pkcs7-mime" || params["smime-type"] != "enveloped-data" {
+			t.Fatalf("content type: %s %v", mediaType, params)
+		}
+		enveloped, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(body), "\r\n", ""))
+		if err != nil {
+			t.Fatalf("decode enveloped data: %s", err.Error())
+		}
+
+		for i := range keys {
+			entity := testSMIMEDecrypt(t, enveloped, keys[i], certs[i])
+			if sign {
+				mediaType, params, body = testSMIMEBody(t, append([]byte("SUBJECT: This is a subject of email.\r\n"), entity...))
+				entity, _ = testSMIMESigned(t, mediaType, params, body)
+			}
+			if !bytes.HasPrefix(entity, []byte("Content-Type: multipart/mixed;\r\n")) ||
+				!bytes.Contains(entity, []byte("VGhpcyBpcyBhIHRleHQvcGxhaW4gYm9k")) {
+				t.Fatalf("decrypted entity:\n%s", entity)
+			}
+		}
+	}
+
+	// Only the RSA keys of recipients are supported.
+	m := testTraceMessage()
+	m.SetSMIMERecipients(signer.Certificate)
+	if _, err = m.WriteTo(&bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "unsupported key") {
+		t.Fatalf("expected error of unsupported key, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package mailx
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// @author valor.
+
+const traceTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// tracer writes the transcript of an SMTP session, one line per command
+// or reply, e.g. "2024-05-11T08:00:00.000Z C: EHLO localhost".
+//
+// The payloads of AUTH are redacted, and so is the message after DATA,
+// unless body is set.
+type tracer struct {
+	w    io.Writer
+	body bool
+
+	mu sync.Mutex
+	// rbuf and wbuf are the partial lines read and written.
+	rbuf, wbuf []byte
+
+	// auth is set between the AUTH command and its final reply.
+	auth bool
+	// data is set from DATA to the final dot, after the 354 reply.
+	data    bool
+	dataCmd bool
+	// dataSize is the size of the redacted message.
+	dataSize int
+}
+
+func (t *tracer) printf(dir, line string) {
+	io.WriteString(t.w, time.Now().Format(traceTimeFormat)+" "+dir+line+"\n")
+}
+
+// event writes a line of an event, e.g. the TLS handshake.
+func (t *tracer) event(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.printf("* ", line)
+}
+
+// lines splits the complete lines from the buffer.
+func lines(buf *[]byte, p []byte, fn func(string)) {
+	*buf = append(*buf, p...)
+	for {
+		i := bytes.IndexByte(*buf, '\n')
+		if i < 0 {
+			return
+		}
+		fn(strings.TrimSuffix(string((*buf)[:i]), "\r"))
+		*buf = (*buf)[i+1:]
+	}
+}
+
+func (t *tracer) client(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines(&t.wbuf, p, func(line string) {
+		switch {
+		case t.data:
+			if line == "." {
+				t.data = false
+				if !t.body {
+					t.printf("C: ", "[message redacted: "+strconv.Itoa(t.dataSize)+" bytes]")
+				}
+				t.printf("C: ", line)
+				return
+			}
+			if t.body {
+				t.printf("C: ", line)
+			} else {
+				t.dataSize += len(line) + 2
+			}
+		case t.auth:
+			t.printf("C: ", "[redacted]")
+		default:
+			verb := strings.ToUpper(line)
+			if i := strings.IndexByte(verb, ' '); i >= 0 {
+				verb = verb[:i]
+			}
+			switch verb {
+			case "AUTH":
+				t.auth = true
+				if fields := strings.Fields(line); len(fields) > 2 {
+					line = fields[0] + " " + fields[1] + " [redacted]"
+				}
+			case "DATA":
+				t.dataCmd = true
+			}
+			t.printf("C: ", line)
+		}
+	})
+}
+
+func (t *tracer) server(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines(&t.rbuf, p, func(line string) {
+		t.printf("S: ", line)
+		if len(line) < 4 || line[3] == '-' {
+			// not the last line of a reply
+			return
+		}
+		code := line[:3]
+		if t.auth && code != "334" {
+			t.auth = false
+		}
+		if t.dataCmd {
+			t.dataCmd = false
+			if code == "354" {
+				t.data, t.dataSize = true, 0
+			}
+		}
+	})
+}
+
+// traceConn writes the transcript of the connection to the tracer.
+type traceConn struct {
+	net.Conn
+	t *tracer
+}
+
+// Read implements io.Reader.
+func (c *traceConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.t.server(p[:n])
+	}
+	return n, err
+}
+
+// Write implements io.Writer.
+func (c *traceConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.t.client(p[:n])
+	}
+	return n, err
+}
+
+// startTLS wraps the underlying connection with TLS,
+// so that the transcript is still written in plaintext.
+func (c *traceConn) startTLS(config *tls.Config) net.Conn {
+	c.t.event("STARTTLS")
+	return &traceConn{Conn: tls.Client(c.Conn, config), t: c.t}
+}
+
+// isTLSConn reports whether the connection is encrypted by TLS.
+func isTLSConn(conn net.Conn) bool {
+	if c, ok := conn.(*traceConn); ok {
+		conn = c.Conn
+	}
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
@@ -0,0 +1,140 @@
+package mailx
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+var traceScript = []string{
+	"C: AUTH PLAIN",
+	"S: 235 2.7.0 Authentication successful",
+	"C: MAIL FROM:<alex@example.com>",
+	"S: 250 2.1.0 Ok",
+	"C: RCPT TO:<aaa@example.com>",
+	"S: 250 2.1.5 Ok",
+	"C: DATA",
+	"S: 354 End data with <CR><LF>.<CR><LF>",
+	"C: <DATA>",
+	"S: 250 2.0.0 Ok: queued as 4F2A1",
+	"C: QUIT",
+	"S: 221 2.0.0 Bye",
+}
+
+func testTraceMessage() *Message {
+	m := NewMessage()
+	m.SetSender("alex@example.com")
+	m.SetTo("aaa@example.com")
+	m.SetSubject("This is a subject of email.")
+	m.SetPlainBody("This is a text/plain body.")
+	return m
+}
+
+func TestTrace(t *testing.T) {
+	for _, body := range []bool{false, true} {
+		var done <-chan error
+		trace := &bytes.Buffer{}
+		d := &Dialer{
+			Host:     "localhost",
+			Port:     25,
+			Username: "user",
+			Password: "pass",
+
+			StartTLSPolicy: NoStartTLS,
+			Trace:          trace,
+			TraceBody:      body,
+		}
+		d.NetDialer = scriptDialer(append([]string{
+			"S: 220 localhost ESMTP",
+			"C: EHLO localhost",
+			"S: 250-localhost",
+			"S: 250 AUTH PLAIN",
+		}, traceScript...), &done)
+
+		if err := d.Send(context.Background(), testTraceMessage()); err != nil {
+			t.Fatalf("send: %s", err.Error())
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("server: %s", err.Error())
+		}
+
+		s := trace.String()
+		for _, want := range []string{
+			"* connected to localhost:25 (tcp)\n",
+			" C: EHLO localhost\n",
+			" S: 250-localhost\n",
+			" C: AUTH PLAIN [redacted]\n",
+			" S: 235 2.7.0 Authentication successful\n",
+			" C: .\n",
+			" S: 250 2.0.0 Ok: queued as 4F2A1\n",
+		} {
+			if !strings.Contains(s, want) {
+				t.Fatalf("missing %q in transcript:\n%s", want, s)
+			}
+		}
+		if strings.Contains(s, "AHVzZXIAcGFzcw==") {
+			t.Fatalf("unredacted AUTH in transcript:\n%s", s)
+		}
+		if strings.Contains(s, "SUBJECT: ") != body || strings.Contains(s, "[message redacted: ") == body {
+			t.Fatalf("invalid message in transcript:\n%s", s)
+		}
+	}
+}
+
+func TestTraceStartTLS(t *testing.T) {
+	cert, pool := testCertificate(t, "localhost")
+	trace := &bytes.Buffer{}
+	d := &Dialer{
+		Host:     "localhost",
+		Port:     587,
+		Username: "user",
+		Password: "pass",
+
+		StartTLSPolicy: MandatoryStartTLS,
+		TLSConfig:      &tls.Config{ServerName: "localhost", RootCAs: pool},
+		Trace:          trace,
+	}
+
+	done := make(chan error, 1)
+	d.NetDialer = func(context.Context, string, string) (net.Conn, error) {
+		c, s := net.Pipe()
+		go func() {
+			defer s.Close()
+			err := playScript(textproto.NewConn(s), []string{
+				"S: 220 localhost ESMTP",
+				"C: EHLO localhost",
+				"S: 250-localhost",
+				"S: 250 STARTTLS",
+				"C: STARTTLS",
+				"S: 220 2.0.0 Ready to start TLS",
+			})
+			if err == nil {
+				tlsConn := tls.Server(s, &tls.Config{Certificates: []tls.Certificate{cert}})
+				err = playScript(textproto.NewConn(tlsConn), append([]string{
+					"C: EHLO localhost",
+					"S: 250-localhost",
+					"S: 250 AUTH PLAIN",
+				}, traceScript...))
+			}
+			done <- err
+		}()
+		return c, nil
+	}
+
+	if err := d.Send(context.Background(), testTraceMessage()); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server: %s", err.Error())
+	}
+
+	s := trace.String()
+	i := strings.Index(s, "* STARTTLS\n")
+	if i < 0 || strings.Count(s, " C: EHLO localhost\n") != 2 || !strings.Contains(s[i:], " C: AUTH PLAIN [redacted]\n") {
+		t.Fatalf("invalid transcript:\n%s", s)
+	}
+}
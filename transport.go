@@ -0,0 +1,153 @@
+package mailx
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"strings"
+)
+
+// @author valor.
+
+// Transport delivers emails.
+// It is implemented by *Dialer, *MultiDialer, *SendmailTransport and *MXTransport,
+// by *MaildirTransport, *MboxTransport and *TeeTransport,
+// and by *MemoryTransport and *FileTransport for development.
+type Transport interface {
+	// Send delivers the email to all its recipients.
+	Send(ctx context.Context, m *Message) error
+}
+
+var (
+	_ Transport = (*Dialer)(nil)
+	_ Transport = (*MultiDialer)(nil)
+	_ Transport = (*SendmailTransport)(nil)
+	_ Transport = (*MXTransport)(nil)
+	_ Transport = (*MemoryTransport)(nil)
+	_ Transport = (*FileTransport)(nil)
+	_ Transport = (*MaildirTransport)(nil)
+	_ Transport = (*MboxTransport)(nil)
+	_ Transport = (*TeeTransport)(nil)
+)
+
+// IsTemporary reports whether the delivery failed temporarily
+// and may succeed if it is retried later, e.g. a network error
+// or a transient negative reply (4xx) of the server.
+//
+// A permanent negative reply (5xx), a *RcptError of the recipients
+// (which may have partially received the message), a *CopyError
+// (the message was sent), an error of the message itself, e.g. of
+// rendering or signing it, and a canceled context are not temporary.
+//
+// A *RateLimitError is temporary, but it is of the local RateLimiter,
+// not of the server, so MultiDialer neither fails over on it nor
+// counts it as a failure of the relay.
+func IsTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if isRateLimited(err) {
+		return true
+	}
+
+	var rcptErr *RcptError
+	if errors.As(err, &rcptErr) {
+		return false
+	}
+	var copyErr *CopyError
+	if errors.As(err, &copyErr) {
+		return false
+	}
+	if isMessageError(err) {
+		return false
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code/100 == 4
+	}
+	return true
+}
+
+// messageError is an error of the message itself, e.g. a missing header
+// or a failure of signing it, which fails the same on each relay.
+type messageError struct {
+	err error
+}
+
+// Error implements error.
+func (e *messageError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *messageError) Unwrap() error {
+	return e.err
+}
+
+// isMessageError reports whether err is of the message itself.
+func isMessageError(err error) bool {
+	var msgErr *messageError
+	return errors.As(err, &msgErr)
+}
+
+// isRateLimited reports whether err is of the local RateLimiter.
+func isRateLimited(err error) bool {
+	var limitErr *RateLimitError
+	return errors.As(err, &limitErr)
+}
+
+// TeeTransport sends each email via Transport,
+// and then writes a copy of it with each of Copies,
+// e.g. to archive the emails sent to a Maildir.
+type TeeTransport struct {
+	// Transport sends the emails.
+	Transport Transport
+	// Copies writes the copies of the emails sent.
+	Copies []Transport
+}
+
+// CopyError is returned by TeeTransport if the email was sent,
+// but some copies of it were not written.
+type CopyError struct {
+	// Errs is the errors of the failed copies.
+	Errs []error
+}
+
+// Error implements error.
+func (e *CopyError) Error() string {
+	b := &strings.Builder{}
+	b.WriteString("email sent, but failed to copy it:")
+	for _, err := range e.Errs {
+		b.WriteString(" " + err.Error() + ";")
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+// Send implements Transport.
+// The message is rendered once, so that the copies are exactly the one
+// sent, with the same 'MESSAGE-ID', 'DATE' and signatures. The files in
+// 8bit are encoded by base64, since the server may not support 8BITMIME.
+// The copies are not written if the email is not sent.
+func (t *TeeTransport) Send(ctx context.Context, m *Message) error {
+	m, err := m.freeze(ctx, "")
+	if err != nil {
+		return err
+	}
+	if err = t.Transport.Send(ctx, m); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, c := range t.Copies {
+		if err := c.Send(ctx, m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return &CopyError{Errs: errs}
+	}
+	return nil
+}